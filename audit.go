@@ -0,0 +1,118 @@
+package fig
+
+import (
+	"encoding/hex"
+	"time"
+)
+
+// auditName is the file/doc name of the audit log within the storage path.
+const auditName = "_audit"
+
+// ChangeStatus is the outcome of executing one Change.
+type ChangeStatus string
+
+const (
+	ChangeApplied ChangeStatus = "applied"
+	ChangeFailed  ChangeStatus = "failed"
+	ChangeSkipped ChangeStatus = "skipped"
+)
+
+// ChangeResult records the outcome of executing one Change.
+type ChangeResult struct {
+	DocPath string       `json:"docPath" firestore:"docPath"`
+	Command Command      `json:"command" firestore:"command"`
+	Status  ChangeStatus `json:"status" firestore:"status"`
+	Error   string       `json:"error,omitempty" firestore:"error,omitempty"`
+}
+
+// RunReport records one execution of a migration. A report is appended to the audit
+// log in the storage path every time RunMigration runs.
+type RunReport struct {
+	Migration    string         `json:"migration" firestore:"migration"`
+	DatabaseName string         `json:"databaseName" firestore:"databaseName"`
+	Environment  string         `json:"environment,omitempty" firestore:"environment,omitempty"`
+	Operator     string         `json:"operator" firestore:"operator"`
+	PlanHash     string         `json:"planHash" firestore:"planHash"`
+	Started      time.Time      `json:"started" firestore:"started"`
+	Finished     time.Time      `json:"finished" firestore:"finished"`
+	Results      []ChangeResult `json:"results" firestore:"results"`
+	Verification *Verification  `json:"verification,omitempty" firestore:"verification,omitempty"`
+	Backup       string         `json:"backup,omitempty" firestore:"backup,omitempty"`
+}
+
+// Skipped returns the results of changes skipped because a precondition did not hold.
+func (r *RunReport) Skipped() []ChangeResult {
+	skipped := []ChangeResult{}
+	for _, res := range r.Results {
+		if res.Status == ChangeSkipped {
+			skipped = append(skipped, res)
+		}
+	}
+	return skipped
+}
+
+// appliedCount returns the number of changes that applied.
+func (r *RunReport) appliedCount() int {
+	return len(r.Results) - len(r.Skipped()) - len(r.Failed())
+}
+
+// Failed returns the results of changes that did not apply.
+func (r *RunReport) Failed() []ChangeResult {
+	failed := []ChangeResult{}
+	for _, res := range r.Results {
+		if res.Status == ChangeFailed {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// planHash returns the content hash of the staged changes as they would be stored, before
+// execution. It identifies the plan a reviewer approved.
+func (m *Migrator) planHash() (string, error) {
+	plan, err := m.buildMigration()
+	if err != nil {
+		return "", err
+	}
+	plan.Timestamp = time.Time{}
+	plan.Executed = false
+	plan.Verification = nil
+	digest, err := migrationDigest(*plan)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+// presentHash returns the plan hash shown for the staged changes and records it as the plan
+// presented. A run refuses once the staged changes no longer match the plan presented last.
+func (m *Migrator) presentHash() string {
+	hash, err := m.planHash()
+	if err != nil {
+		return "unavailable"
+	}
+	m.presented = hash
+	return hash
+}
+
+// SetOperator sets the operator identity recorded in the audit log. Defaults to user@host.
+func (m *Migrator) SetOperator(operator string) {
+	m.operator = operator
+}
+
+// operatorName returns the configured operator or a description of the current user.
+func (m *Migrator) operatorName() string {
+	if m.operator != "" {
+		return m.operator
+	}
+	return operatorIdentity()
+}
+
+// appendAudit appends a run report to the audit log in the migration store.
+func (m *Migrator) appendAudit(report *RunReport) error {
+	store, err := m.migrationStore()
+	if err != nil {
+		return err
+	}
+	return storeAudit(store, report)
+}
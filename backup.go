@@ -0,0 +1,261 @@
+package fig
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// backupTag separates the migration name from the backup timestamp in a backup name.
+const backupTag = "_backup_"
+
+// Backup is a point in time copy of the documents a migration run was about to write. Deleted
+// documents are copied with every document in their subcollections. Document data is encoded
+// with the type of every value, so a restore writes back exactly the values that were read.
+type Backup struct {
+	Migration    string      `json:"migration" firestore:"migration"`
+	DatabaseName string      `json:"databaseName" firestore:"databaseName"`
+	Environment  string      `json:"environment,omitempty" firestore:"environment,omitempty"`
+	Taken        time.Time   `json:"taken" firestore:"taken"`
+	Documents    []BackupDoc `json:"documents" firestore:"documents"`
+}
+
+// BackupDoc is one document in a Backup. Documents which did not exist are recorded so a
+// restore deletes anything written to their paths since.
+type BackupDoc struct {
+	DocPath string         `json:"docPath" firestore:"docPath"`
+	Exists  bool           `json:"exists" firestore:"exists"`
+	Data    map[string]any `json:"data,omitempty" firestore:"data,omitempty"`
+}
+
+// SetBackup makes RunMigration archive every targeted document immediately before writing.
+func (m *Migrator) SetBackup(backup bool) {
+	m.backup = backup
+}
+
+// takeBackup reads the current state of every targeted document and saves it under a
+// timestamped name in the migration store. It returns the backup name.
+func (m *Migrator) takeBackup() (string, error) {
+	b := Backup{
+		Migration:    m.name,
+		DatabaseName: m.database.name(),
+		Environment:  m.environment,
+		Taken:        time.Now(),
+		Documents:    []BackupDoc{},
+	}
+	seen := map[string]bool{}
+	for _, c := range m.changes {
+		if err := m.backupDoc(&b, c.docPath, c.command == MigratorDelete, seen); err != nil {
+			return "", err
+		}
+	}
+	name := m.name + backupTag + b.Taken.UTC().Format("20060102T150405.000000000Z")
+	store, err := m.migrationStore()
+	if err != nil {
+		return "", err
+	}
+	return name, store.Save(name, b)
+}
+
+// backupDoc adds a document to the backup, descending into its subcollections if deep.
+func (m *Migrator) backupDoc(b *Backup, docPath string, deep bool, seen map[string]bool) error {
+	if !seen[docPath] {
+		seen[docPath] = true
+		data, exists, err := m.database.readDoc(docPath)
+		if err != nil {
+			return err
+		}
+		doc := BackupDoc{DocPath: docPath, Exists: exists}
+		if exists {
+			doc.Data = encodeTyped(data, m.database).(map[string]any)
+		}
+		b.Documents = append(b.Documents, doc)
+	}
+	if !deep {
+		return nil
+	}
+	cols, err := m.database.listCollections(docPath)
+	if err != nil {
+		return err
+	}
+	for _, col := range cols {
+		paths, err := m.database.listDocPaths(col)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if err := m.backupDoc(b, p, true, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreBackup replays a backup taken by RunMigration. Each document is written back exactly
+// as it was and documents which did not exist are deleted. The restore does not use the
+// staged changes or the rollback, and holds the execution lock while it writes.
+func (m *Migrator) RestoreBackup(name string) error {
+	store, err := m.migrationStore()
+	if err != nil {
+		return err
+	}
+	var b Backup
+	if err := store.Load(name, &b); err != nil {
+		return err
+	}
+	if b.DatabaseName != m.database.name() && !m.retarget {
+		return fmt.Errorf("Backup was taken from database %s but the connected database is %s.", b.DatabaseName, m.database.name())
+	}
+	lock, err := m.acquireLock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	failures := []string{}
+	for _, doc := range b.Documents {
+		if err := lock.lost(); err != nil {
+			return fmt.Errorf("Restore aborted: %w", err)
+		}
+		var err error
+		if doc.Exists {
+			var fields map[string]any
+			if fields, err = decodeDoc(doc.Data, m.database); err == nil {
+				err = m.database.setDoc(doc.DocPath, fields)
+			}
+		} else {
+			err = m.database.deleteDoc(doc.DocPath)
+		}
+		if err != nil {
+			failures = append(failures, doc.DocPath+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d documents failed to restore:\n%s", len(failures), len(b.Documents), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// encodeTyped converts a Firestore value to a json safe form which records its type. Each value
+// becomes a map with one key naming the type. Numbers are kept as strings so integers and
+// doubles survive json exactly, and timestamps keep nanoseconds. References into the connected
+// database are kept relative, so encoded documents can be written to another environment.
+func encodeTyped(v any, f figFirestore) any {
+	switch t := v.(type) {
+	case nil:
+		return map[string]any{"null": true}
+	case bool:
+		return map[string]any{"boolean": t}
+	case string:
+		return map[string]any{"string": t}
+	case []byte:
+		return map[string]any{"bytes": base64.StdEncoding.EncodeToString(t)}
+	case time.Time:
+		return map[string]any{"timestamp": t.Format(time.RFC3339Nano)}
+	case *firestore.DocumentRef:
+		if t == nil {
+			return map[string]any{"null": true}
+		}
+		return map[string]any{"reference": refPath(t.Path, f)}
+	case *latlng.LatLng:
+		return map[string]any{"geopoint": []any{t.Latitude, t.Longitude}}
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"integer": strconv.FormatInt(rv.Int(), 10)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"integer": strconv.FormatUint(rv.Uint(), 10)}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"double": strconv.FormatFloat(rv.Float(), 'g', -1, 64)}
+	case reflect.Map:
+		m := map[string]any{}
+		for k, val := range toMapAny(v) {
+			m[k] = encodeTyped(val, f)
+		}
+		return map[string]any{"map": m}
+	case reflect.Slice, reflect.Array:
+		a := []any{}
+		for _, val := range toSliceAny(v) {
+			a = append(a, encodeTyped(val, f))
+		}
+		return map[string]any{"array": a}
+	}
+	return map[string]any{"string": fmt.Sprintf("%v", v)}
+}
+
+// decodeTyped converts a value encoded by encodeTyped back to the Firestore value it was.
+func decodeTyped(v any, f figFirestore) (any, error) {
+	tagged, ok := v.(map[string]any)
+	if !ok || len(tagged) != 1 {
+		return nil, fmt.Errorf("Malformed typed value %v.", v)
+	}
+	for kind, val := range tagged {
+		switch kind {
+		case "null":
+			return nil, nil
+		case "boolean":
+			return val, nil
+		case "string":
+			return val, nil
+		case "bytes":
+			return base64.StdEncoding.DecodeString(fmt.Sprint(val))
+		case "timestamp":
+			return time.Parse(time.RFC3339Nano, fmt.Sprint(val))
+		case "reference":
+			return f.refField(fmt.Sprint(val)), nil
+		case "geopoint":
+			ll, ok := val.([]any)
+			if !ok || len(ll) != 2 {
+				return nil, fmt.Errorf("Malformed typed geopoint %v.", val)
+			}
+			return &latlng.LatLng{Latitude: toFloat(ll[0]), Longitude: toFloat(ll[1])}, nil
+		case "integer":
+			return strconv.ParseInt(fmt.Sprint(val), 10, 64)
+		case "double":
+			return strconv.ParseFloat(fmt.Sprint(val), 64)
+		case "map":
+			out := map[string]any{}
+			for k, field := range toMapAny(val) {
+				d, err := decodeTyped(field, f)
+				if err != nil {
+					return nil, err
+				}
+				out[k] = d
+			}
+			return out, nil
+		case "array":
+			out := []any{}
+			for _, item := range toSliceAny(val) {
+				d, err := decodeTyped(item, f)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, d)
+			}
+			return out, nil
+		}
+		return nil, fmt.Errorf("Unknown typed value type %s.", kind)
+	}
+	return nil, nil
+}
+
+// decodeDoc converts document data encoded by encodeTyped back to the document it was.
+func decodeDoc(data map[string]any, f figFirestore) (map[string]any, error) {
+	decoded, err := decodeTyped(data, f)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("Malformed typed document %v.", data)
+	}
+	return doc, nil
+}
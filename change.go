@@ -18,19 +18,29 @@ const (
 	MigratorSet
 	MigratorAdd
 	MigratorDelete
+	MigratorUpdateFields
+	MigratorSetMerge
 )
 
 // Change represents one change on one document. A change must contain enough data points to be solved.
 // For example, given a before and a patch, we can solve for the after value.
 type Change struct {
 	docPath    string
+	staged     map[string]any
 	before     map[string]any
 	patch      map[string]any
 	after      map[string]any
 	command    Command
-	prettyDiff string
+	diff       []FieldChange
 	rollback   map[string]any
 	errState   error
+	violations []Violation
+	fields     [][]string
+	conditions []Condition
+	skipped    bool
+	step       int
+	steps      int
+	net        []FieldChange
 	database   figFirestore
 	cache      map[string]map[string]any
 }
@@ -43,6 +53,7 @@ func NewChange(docPath string,
 	database figFirestore) *Change {
 	c := Change{
 		docPath:  docPath,
+		staged:   before,
 		before:   before,
 		patch:    patch,
 		command:  command,
@@ -67,7 +78,7 @@ func (c *Change) SolveChange() error {
 		c.errState = err
 		return err
 	}
-	err = c.inferPrettyDiff()
+	err = c.inferDiff()
 	if err != nil {
 		c.errState = err
 		return err
@@ -91,11 +102,24 @@ func (c *Change) commandString() string {
 		return "add"
 	case MigratorDelete:
 		return "delete"
+	case MigratorUpdateFields:
+		return "updateFields"
+	case MigratorSetMerge:
+		return "setMerge"
 	default:
 		return "unknown"
 	}
 }
 
+// collectionPath returns the path of the collection holding the Change's document.
+func (c *Change) collectionPath() string {
+	i := strings.LastIndex(c.docPath, "/")
+	if i < 0 {
+		return ""
+	}
+	return c.docPath[:i]
+}
+
 // inferAfter attempts to solve for the Change's after value.
 func (c *Change) inferAfter() error {
 
@@ -105,11 +129,39 @@ func (c *Change) inferAfter() error {
 			c.after = c.patch
 			return nil
 		case MigratorAdd:
+			if len(c.before) > 0 {
+				return errors.New("Document already exists. Add only creates new documents.")
+			}
 			c.after = c.patch
 			return nil
 		case MigratorDelete:
 			c.after = map[string]any{}
 			return nil
+		case MigratorUpdate:
+			if c.before == nil || c.patch == nil {
+				return errors.New("Need before and patch to infer after.")
+			}
+			// merged natively rather than through json, so fields the patch does not touch
+			// keep their exact values
+			c.after = mergeMaps(cloneData(c.before).(map[string]any), c.patch)
+			return nil
+		case MigratorUpdateFields:
+			if len(c.before) == 0 {
+				return errors.New("Field updates need an existing document.")
+			}
+			updates, err := patchFieldUpdates(c.patch)
+			if err != nil {
+				return err
+			}
+			c.after = applyFieldUpdates(c.before, updates, c.database)
+			return nil
+		case MigratorSetMerge:
+			updates, err := mergeFieldUpdates(c.patch, c.fields)
+			if err != nil {
+				return err
+			}
+			c.after = applyFieldUpdates(c.before, updates, c.database)
+			return nil
 		}
 
 	}
@@ -175,7 +227,7 @@ func (c *Change) inferRollback() error {
 	}
 	// due to issues rolling back added fields caused by ambiguity of serialized null
 	// to rollback an update/set, we just do a set to before or a delete
-	if c.command == MigratorSet || c.command == MigratorUpdate {
+	if c.command == MigratorSet || c.command == MigratorUpdate || c.command == MigratorUpdateFields || c.command == MigratorSetMerge {
 		c.rollback = c.before
 		return nil
 	}
@@ -196,25 +248,64 @@ func (c *Change) inferRollback() error {
 	return nil
 }
 
-// inferPrettyDiff attempts to solve for the Change's prettyDiff value.
-func (c *Change) inferPrettyDiff() error {
+// inferDiff attempts to solve for the Change's field level diff.
+func (c *Change) inferDiff() error {
 
 	if c.before == nil || c.after == nil {
-		return errors.New("Need before and after value to infer pretty diff.")
-	}
-
-	sBefore, sAfter := c.beforeAfterCache()
-	s, err := prettyDiff(sBefore, sAfter)
-	if err != nil {
-		return err
+		return errors.New("Need before and after value to infer diff.")
 	}
 
-	c.prettyDiff = s
+	c.diff = diffData(c.before, c.after, c.database)
 	return nil
 }
 
+// Diff returns the field level differences between the Change's before and after values.
+func (c *Change) Diff() []FieldChange {
+	return c.diff
+}
+
+// DocPath returns the path of the document the Change targets.
+func (c *Change) DocPath() string {
+	return c.docPath
+}
+
+// Command returns the command the Change executes.
+func (c *Change) Command() Command {
+	return c.command
+}
+
+// Before returns the document before the Change.
+func (c *Change) Before() map[string]any {
+	return c.before
+}
+
+// Patch returns the data the Change writes.
+func (c *Change) Patch() map[string]any {
+	return c.patch
+}
+
+// After returns the document after the Change.
+func (c *Change) After() map[string]any {
+	return c.after
+}
+
+// Err returns the error the Change was left in when solved, if any.
+func (c *Change) Err() error {
+	return c.errState
+}
+
 // Present returns a pretty representation of the change for printing to stdout.
 func (c *Change) Present() ([]string, string) {
+	return c.present(false)
+}
+
+// PresentAbbreviated is like Present but long arrays and strings in the diff are truncated.
+func (c *Change) PresentAbbreviated() ([]string, string) {
+	return c.present(true)
+}
+
+// present returns a pretty representation of the change with a full or abbreviated diff.
+func (c *Change) present(abbreviated bool) ([]string, string) {
 	out := ""
 	header := []string{"Target: " + clrTheme().blue(c.docPath), fmt.Sprintf(" >> [%s]", strings.ToUpper(c.commandString())) + "\n\n"}
 
@@ -222,20 +313,35 @@ func (c *Change) Present() ([]string, string) {
 		out += fmt.Sprintf("< !!! ERROR STATE !!! >\n")
 		out += fmt.Sprintf(c.errState.Error() + "\n")
 		return header, out
-
-	} else if len(c.prettyDiff) == 0 {
+	}
+	if c.steps > 1 {
+		out += fmt.Sprintf("Step %d of %d on this document\n\n", c.step, c.steps)
+	}
+	if len(c.conditions) > 0 {
+		out += fmt.Sprintf("Only if: %s\n\n", c.describeConditions())
+	}
+	if len(c.fields) > 0 {
+		out += fmt.Sprintf("Merge fields: %s\n\n", strings.Join(fieldPathStrings(c.fields), ", "))
+	}
+	if len(c.diff) == 0 {
 		out += fmt.Sprintf("< no changes >\n")
 
 	} else {
-		replace := []string{"<time>", "<delete>", "<ref>"}
-		s := c.prettyDiff
-
-		for _, r := range replace {
-			s = strings.Replace(s, `"`+r, "", -1)
-			s = strings.Replace(s, r+`"`, "", -1)
+		out += renderDiff(c.diff, c.database, abbreviated)
+	}
+	if c.steps > 1 && c.finalChange() {
+		out += fmt.Sprintf("\n< NET CHANGE OVER %d STEPS >\n", c.steps)
+		if len(c.net) == 0 {
+			out += fmt.Sprintf("< no changes >\n")
+		} else {
+			out += renderDiff(c.net, c.database, abbreviated)
+		}
+	}
+	if len(c.violations) > 0 {
+		out += "\n" + clrTheme().red("< SCHEMA VIOLATIONS >") + "\n"
+		for _, v := range c.violations {
+			out += fmt.Sprintf("    %s%s: %s\n", clrTheme().red("x "), v.Path, v.Message)
 		}
-
-		out += fmt.Sprintf(s + "\n")
 	}
 	return header, out
 
@@ -244,13 +350,24 @@ func (c *Change) Present() ([]string, string) {
 // pushChange executes this change unit against the database.
 func (c *Change) pushChange(transformer func(map[string]any) map[string]any) error {
 	data := transformer(c.patch)
+	if len(c.conditions) > 0 {
+		return c.pushConditional(data)
+	}
 	switch c.command {
 	case MigratorUpdate:
 		return c.database.updateDoc(c.docPath, data)
+	case MigratorUpdateFields:
+		updates, err := patchFieldUpdates(data)
+		if err != nil {
+			return err
+		}
+		return c.database.updateFields(c.docPath, updates)
+	case MigratorSetMerge:
+		return c.database.setMerge(c.docPath, data, c.fields)
 	case MigratorSet:
 		return c.database.setDoc(c.docPath, data)
 	case MigratorAdd:
-		return c.database.setDoc(c.docPath, data)
+		return c.database.createDoc(c.docPath, data)
 	default:
 		return c.database.deleteDoc(c.docPath)
 	}
@@ -0,0 +1,61 @@
+package fig
+
+import (
+	"errors"
+)
+
+// solveChanges solves every change in order. Changes on the same document are composed, so
+// each one starts from the after value of the change before it and the last one holds the
+// net diff from the first before value.
+func (m *Migrator) solveChanges() {
+	first := map[string]*Change{}
+	last := map[string]*Change{}
+	for _, c := range m.changes {
+		c.step, c.steps, c.net = 1, 1, nil
+		c.cache = map[string]map[string]any{}
+		prev, ok := last[c.docPath]
+		last[c.docPath] = c
+		if !ok {
+			first[c.docPath] = c
+			c.before = c.staged
+			c.SolveChange()
+			continue
+		}
+		c.step = prev.step + 1
+		if prev.errState != nil {
+			c.before = nil
+			c.errState = errors.New("An earlier change on this document is in an error state.")
+			continue
+		}
+		c.before = prev.after
+		c.SolveChange()
+	}
+	for _, c := range m.changes {
+		c.steps = last[c.docPath].step
+	}
+	for docPath, c := range last {
+		if c.steps > 1 && c.errState == nil {
+			c.net = diffData(first[docPath].before, c.after, m.database)
+		}
+	}
+}
+
+// finalChange reports whether the change is the last one on its document.
+func (c *Change) finalChange() bool {
+	return c.step == c.steps
+}
+
+// reverseComposed reverses the order of the units on each document in place, so changes
+// composed on one document are undone last step first. Units on other documents keep their
+// positions.
+func reverseComposed(units []WorkUnit) {
+	positions := map[string][]int{}
+	for i, u := range units {
+		positions[u.DocPath] = append(positions[u.DocPath], i)
+	}
+	for _, idx := range positions {
+		for i, j := 0, len(idx)-1; i < j; i, j = i+1, j-1 {
+			units[idx[i]], units[idx[j]] = units[idx[j]], units[idx[i]]
+		}
+	}
+}
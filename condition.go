@@ -0,0 +1,132 @@
+package fig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConditionKind is an enum of the preconditions a change can be staged with.
+type ConditionKind string
+
+const (
+	ConditionExists      ConditionKind = "exists"
+	ConditionNotExists   ConditionKind = "notExists"
+	ConditionFieldEquals ConditionKind = "fieldEquals"
+)
+
+// Condition is a precondition checked against the live document when a change runs. A change
+// whose conditions do not all hold is skipped.
+type Condition struct {
+	Kind  ConditionKind `json:"kind" firestore:"kind"`
+	Field string        `json:"field,omitempty" firestore:"field,omitempty"`
+	Value any           `json:"value,omitempty" firestore:"value,omitempty"`
+}
+
+// errConditionFailed is returned by a conditional push when a precondition does not hold.
+var errConditionFailed = errors.New("Precondition failed.")
+
+// IfExists is a Condition which holds when the document exists.
+func IfExists() Condition {
+	return Condition{Kind: ConditionExists}
+}
+
+// IfNotExists is a Condition which holds when the document does not exist.
+func IfNotExists() Condition {
+	return Condition{Kind: ConditionNotExists}
+}
+
+// IfFieldEquals is a Condition which holds when the field at the path string equals value.
+func IfFieldEquals(field string, value any) Condition {
+	return Condition{Kind: ConditionFieldEquals, Field: field, Value: value}
+}
+
+// holds reports whether the condition holds for the document.
+func (cond Condition) holds(data map[string]any, exists bool) (bool, error) {
+	switch cond.Kind {
+	case ConditionExists:
+		return exists, nil
+	case ConditionNotExists:
+		return !exists, nil
+	case ConditionFieldEquals:
+		path, err := parseFieldPath(cond.Field)
+		if err != nil {
+			return false, err
+		}
+		v, ok := lookupPath(data, path)
+		return ok && valueType(v) == valueType(cond.Value) && equalValues(v, cond.Value), nil
+	}
+	return false, fmt.Errorf("Unknown condition %s.", cond.Kind)
+}
+
+// describe returns a readable form of the condition.
+func (cond Condition) describe(f figFirestore) string {
+	switch cond.Kind {
+	case ConditionExists:
+		return "document exists"
+	case ConditionNotExists:
+		return "document does not exist"
+	case ConditionFieldEquals:
+		return fmt.Sprintf("%s == %s", cond.Field, formatValue(cond.Value, f, true))
+	}
+	return string(cond.Kind)
+}
+
+// When returns a stager whose staged changes only run if every condition holds at execution.
+// Conditions are evaluated transactionally with the write.
+func (s Stager) When(conditions ...Condition) FigStager {
+	s.conditions = append(append([]Condition{}, s.conditions...), conditions...)
+	return &s
+}
+
+// describeConditions returns the readable conditions of a change joined with and.
+func (c *Change) describeConditions() string {
+	parts := []string{}
+	for _, cond := range c.conditions {
+		parts = append(parts, cond.describe(c.database))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// pushConditional checks the conditions against the live document and writes the change in
+// the same transaction with the same semantics as an unconditional push, so fields the patch
+// does not touch are left as they are. It returns errConditionFailed when a condition does
+// not hold.
+func (c *Change) pushConditional(data map[string]any) error {
+	check := func(live map[string]any, exists bool) error {
+		for _, cond := range c.conditions {
+			ok, err := cond.holds(live, exists)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%w %s", errConditionFailed, cond.describe(c.database))
+			}
+		}
+		return nil
+	}
+	return c.database.writeIf(c.docPath, check, c.command, data, c.fields)
+}
+
+// serializeConditions converts condition values for storage.
+func serializeConditions(conditions []Condition, f figFirestore) []Condition {
+	if len(conditions) == 0 {
+		return nil
+	}
+	out := []Condition{}
+	for _, cond := range conditions {
+		cond.Value = serializeData(cond.Value, f)
+		out = append(out, cond)
+	}
+	return out
+}
+
+// deSerializeConditions converts stored condition values back to Firestore values.
+func deSerializeConditions(conditions []Condition, f figFirestore) []Condition {
+	out := []Condition{}
+	for _, cond := range conditions {
+		cond.Value = deSerializeData(cond.Value, f)
+		out = append(out, cond)
+	}
+	return out
+}
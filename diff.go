@@ -0,0 +1,289 @@
+package fig
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// DiffKind is an enum of the ways a field can differ between before and after.
+type DiffKind int
+
+const (
+	DiffAdded DiffKind = iota
+	DiffRemoved
+	DiffModified
+	DiffTypeChanged
+)
+
+// String converts a DiffKind to a string.
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffModified:
+		return "modified"
+	default:
+		return "typeChanged"
+	}
+}
+
+// MarshalText encodes a DiffKind as its string.
+func (k DiffKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a DiffKind from its string.
+func (k *DiffKind) UnmarshalText(text []byte) error {
+	for _, kind := range []DiffKind{DiffAdded, DiffRemoved, DiffModified, DiffTypeChanged} {
+		if kind.String() == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown diff kind %s.", string(text))
+}
+
+// FieldChange is one field level difference between a document's before and after values.
+// Path holds one segment per map key or array index so keys containing dots are unambiguous.
+type FieldChange struct {
+	Path []string `json:"path"`
+	Kind DiffKind `json:"kind"`
+	Old  any      `json:"old,omitempty"`
+	New  any      `json:"new,omitempty"`
+}
+
+// simpleSegment matches field path segments which need no quoting.
+var simpleSegment = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*$|^[0-9]+$`)
+
+// PathString returns the path in Firestore field path syntax. Segments which are not simple
+// identifiers are quoted with backticks.
+func (f FieldChange) PathString() string {
+	segments := []string{}
+	for _, s := range f.Path {
+		if simpleSegment.MatchString(s) {
+			segments = append(segments, s)
+		} else {
+			segments = append(segments, "`"+strings.ReplaceAll(s, "`", "\\`")+"`")
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// diffData returns the field level differences between before and after. Firestore values
+// are compared natively: numbers by value regardless of int or float, timestamps by instant at
+// the microsecond precision Firestore stores, references by path, and a delete sentinel in
+// after counts as removal.
+func diffData(before map[string]any, after map[string]any, f figFirestore) []FieldChange {
+	changes := []FieldChange{}
+	diffMaps(before, after, []string{}, f, &changes)
+	return changes
+}
+
+// diffMaps appends the differences between two maps at the given path.
+func diffMaps(before map[string]any, after map[string]any, path []string, f figFirestore, changes *[]FieldChange) {
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	sorted := []string{}
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if inAfter && isDeleteValue(a, f) {
+			inAfter = false
+		}
+		diffValues(b, inBefore, a, inAfter, appendPath(path, k), f, changes)
+	}
+}
+
+// diffValues appends the differences between two values at the given path.
+func diffValues(b any, inBefore bool, a any, inAfter bool, path []string, f figFirestore, changes *[]FieldChange) {
+	switch {
+	case !inBefore && !inAfter:
+		return
+	case !inBefore:
+		*changes = append(*changes, FieldChange{Path: path, Kind: DiffAdded, New: a})
+		return
+	case !inAfter:
+		*changes = append(*changes, FieldChange{Path: path, Kind: DiffRemoved, Old: b})
+		return
+	}
+
+	bType, aType := valueType(b), valueType(a)
+	if bType != aType {
+		*changes = append(*changes, FieldChange{Path: path, Kind: DiffTypeChanged, Old: b, New: a})
+		return
+	}
+	switch bType {
+	case "map":
+		diffMaps(toMapAny(b), toMapAny(a), path, f, changes)
+	case "array":
+		bs, as := toSliceAny(b), toSliceAny(a)
+		for i := 0; i < maxNum(len(bs), len(as)); i++ {
+			var bi, ai any
+			if i < len(bs) {
+				bi = bs[i]
+			}
+			if i < len(as) {
+				ai = as[i]
+			}
+			diffValues(bi, i < len(bs), ai, i < len(as), appendPath(path, strconv.Itoa(i)), f, changes)
+		}
+	default:
+		if !equalValues(b, a) {
+			*changes = append(*changes, FieldChange{Path: path, Kind: DiffModified, Old: b, New: a})
+		}
+	}
+}
+
+// serverTimestampMarker is the serialized form of the server timestamp sentinel.
+const serverTimestampMarker = "<time>!serverTimestamp<time>"
+
+// isServerTimestamp reports whether the value is the server timestamp sentinel.
+func isServerTimestamp(v any) bool {
+	return v != nil && v == any(firestore.ServerTimestamp)
+}
+
+// appendPath returns a new path with the segment appended.
+func appendPath(path []string, segment string) []string {
+	newPath := make([]string, len(path), len(path)+1)
+	copy(newPath, path)
+	return append(newPath, segment)
+}
+
+// isDeleteValue reports whether the value is the database delete sentinel.
+func isDeleteValue(v any, f figFirestore) bool {
+	return v != nil && reflect.DeepEqual(v, f.deleteField())
+}
+
+// valueType returns the Firestore type name of a value.
+func valueType(v any) string {
+	if isServerTimestamp(v) {
+		return "serverTimestamp"
+	}
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case time.Time:
+		return "timestamp"
+	case *firestore.DocumentRef:
+		return "reference"
+	case *latlng.LatLng, latlng.LatLng:
+		return "geopoint"
+	default:
+		switch reflect.ValueOf(t).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return "number"
+		case reflect.Map:
+			return "map"
+		case reflect.Slice, reflect.Array:
+			return "array"
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// equalValues compares two scalar values of the same Firestore type.
+func equalValues(b any, a any) bool {
+	switch bv := b.(type) {
+	case time.Time:
+		return bv.Truncate(time.Microsecond).Equal(a.(time.Time).Truncate(time.Microsecond))
+	case *firestore.DocumentRef:
+		av := a.(*firestore.DocumentRef)
+		if bv == nil || av == nil {
+			return bv == av
+		}
+		return bv.Path == av.Path
+	}
+	if valueType(b) == "number" {
+		return toFloat(b) == toFloat(a)
+	}
+	return reflect.DeepEqual(b, a)
+}
+
+// toFloat converts any numeric value to float64.
+func toFloat(v any) float64 {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	}
+	return 0
+}
+
+// formatValue returns a readable representation of a Firestore value for presentation.
+// Abbreviated values have long arrays and strings truncated.
+func formatValue(v any, f figFirestore, abbreviated bool) string {
+	s := serializeData(v, f)
+	if abbreviated {
+		s = abbreviate(s)
+	}
+	js, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	out := string(js)
+	out = markedValue.ReplaceAllString(out, `$1($2)`)
+	return out
+}
+
+// markedValue matches serialized timestamps, references and deletes within json output.
+var markedValue = regexp.MustCompile(`"<(time|ref|delete)>(.*?)<(?:time|ref|delete)>"`)
+
+// renderDiff returns the colored presentation of field changes, one line per change.
+// Abbreviated diffs truncate long values and show at most maxPresentFields lines.
+func renderDiff(changes []FieldChange, f figFirestore, abbreviated bool) string {
+	out := ""
+	for i, fc := range changes {
+		if abbreviated && i == maxPresentFields {
+			out += fmt.Sprintf("    ... %d more fields\n", len(changes)-maxPresentFields)
+			break
+		}
+		path := fc.PathString()
+		switch fc.Kind {
+		case DiffAdded:
+			out += fmt.Sprintf("    %s%s: %s\n", clrTheme().green("+ "), path, formatValue(fc.New, f, abbreviated))
+		case DiffRemoved:
+			out += fmt.Sprintf("    %s%s: %s\n", clrTheme().red("- "), path, formatValue(fc.Old, f, abbreviated))
+		case DiffModified:
+			out += fmt.Sprintf("    %s%s: %s%s%s\n", clrTheme().yellow("~ "), path,
+				formatValue(fc.Old, f, abbreviated), clrTheme().yellow(" -> "), formatValue(fc.New, f, abbreviated))
+		default:
+			out += fmt.Sprintf("    %s%s: %s (%s)%s%s (%s)\n", clrTheme().yellow("! "), path,
+				formatValue(fc.Old, f, abbreviated), valueType(fc.Old), clrTheme().yellow(" -> "),
+				formatValue(fc.New, f, abbreviated), valueType(fc.New))
+		}
+	}
+	return out
+}
@@ -0,0 +1,207 @@
+package fig
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// encodeStruct converts a struct, or a pointer to one, into document data following the same
+// rules as the Firestore client. Fields are named by their firestore tags, tags of "-" are
+// skipped, omitempty drops zero values, serverTimestamp writes the server time in place of a
+// zero time and embedded structs are flattened.
+func encodeStruct(model any) (map[string]any, error) {
+	v := reflect.ValueOf(model)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, fmt.Errorf("Cannot stage a nil %T.", model)
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Struct staging needs a struct but got %T.", model)
+	}
+	return encodeStructValue(v)
+}
+
+// encodeStructValue converts a struct value into document data.
+func encodeStructValue(v reflect.Value) (map[string]any, error) {
+	data := map[string]any{}
+	for _, f := range structFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok {
+			continue
+		}
+		if f.serverTimestamp && fv.Type() == reflect.TypeOf(time.Time{}) && fv.Interface().(time.Time).IsZero() {
+			data[f.name] = firestore.ServerTimestamp
+			continue
+		}
+		if f.omitempty && isEmptyValue(fv) {
+			continue
+		}
+		enc, err := encodeValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		data[f.name] = enc
+	}
+	return data, nil
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex without panicking on nil embedded pointers.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue reports whether omitempty drops the value.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t.IsZero()
+		}
+	}
+	return false
+}
+
+// encodeValue converts one Go value into the type the Firestore client reads it back as.
+// Integers become int64, floats become float64, structs become maps and slices become []any.
+func encodeValue(v reflect.Value) (any, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	switch x := v.Interface().(type) {
+	case time.Time, *firestore.DocumentRef, *latlng.LatLng, []byte:
+		return x, nil
+	case latlng.LatLng:
+		return &x, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeValue(v.Elem())
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Struct:
+		return encodeStructValue(v)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map keys must be strings but got %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		data := map[string]any{}
+		iter := v.MapRange()
+		for iter.Next() {
+			enc, err := encodeValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			data[iter.Key().String()] = enc
+		}
+		return data, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		items := []any{}
+		for i := 0; i < v.Len(); i++ {
+			enc, err := encodeValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, enc)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("type %s cannot be stored in Firestore", v.Type())
+}
+
+// SetStruct stages a Set change with the document encoded from a struct.
+func (s Stager) SetStruct(docPath string, model any) error {
+	data, err := encodeStruct(model)
+	if err != nil {
+		return err
+	}
+	return s.Set(docPath, data)
+}
+
+// UpdateStruct stages an Update change with the fields encoded from a struct. Tag fields
+// omitempty to leave them untouched when they hold zero values.
+func (s Stager) UpdateStruct(docPath string, model any) error {
+	data, err := encodeStruct(model)
+	if err != nil {
+		return err
+	}
+	return s.Update(docPath, data)
+}
+
+// AddStruct stages an Add change with the document encoded from a struct.
+func (s Stager) AddStruct(colPath string, model any) error {
+	data, err := encodeStruct(model)
+	if err != nil {
+		return err
+	}
+	return s.Add(colPath, data)
+}
+
+// Stage is a stager for documents modeled by the struct type T.
+type Stage[T any] struct {
+	stager FigStager
+}
+
+// NewStage returns a typed stager staging changes through the given stager.
+func NewStage[T any](stager FigStager) Stage[T] {
+	return Stage[T]{stager: stager}
+}
+
+// Set stages a Set change with the document encoded from doc.
+func (s Stage[T]) Set(docPath string, doc T) error {
+	return s.stager.SetStruct(docPath, doc)
+}
+
+// Update stages an Update change with the fields encoded from doc.
+func (s Stage[T]) Update(docPath string, doc T) error {
+	return s.stager.UpdateStruct(docPath, doc)
+}
+
+// Add stages an Add change with the document encoded from doc.
+func (s Stage[T]) Add(colPath string, doc T) error {
+	return s.stager.AddStruct(colPath, doc)
+}
@@ -0,0 +1,58 @@
+package fig
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// ExportCollection copies every document of a collection, and with recursive of its
+// subcollections, to an Export.
+func (m *Migrator) ExportCollection(colPath string, recursive bool) (*Export, error) {
+	docs, err := collectDocs(m.database, colPath, recursive)
+	if err != nil {
+		return nil, err
+	}
+	return &Export{
+		Collection:   colPath,
+		Recursive:    recursive,
+		DatabaseName: m.database.name(),
+		Exported:     time.Now(),
+		Documents:    docs,
+	}, nil
+}
+
+// Save writes the export as indented json with documents sorted by path, so exports kept in
+// version control diff cleanly.
+func (e *Export) Save(path string) error {
+	js, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(js, '\n'), 0644)
+}
+
+// Import stages every document of the export. Documents are Set, overwriting any existing
+// document, or with create they are Added so the migration fails rather than overwrite.
+// Values are imported with the types they were exported with, and relative references are
+// resolved against the connected database.
+func (m *Migrator) Import(e *Export, create bool) error {
+	stager := m.Stage()
+	for _, d := range e.Documents {
+		data, err := decodeDoc(d.Data, m.database)
+		if err != nil {
+			return err
+		}
+		if create {
+			i := strings.LastIndex(d.DocPath, "/")
+			err = stager.AddWithID(d.DocPath[:i], d.DocPath[i+1:], data)
+		} else {
+			err = stager.Set(d.DocPath, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package fig
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldUpdate replaces the value at one field path. Each path segment is one map key, so a
+// key containing dots is a single segment. A value of DeleteField removes the field.
+type FieldUpdate struct {
+	Path  []string
+	Value any
+}
+
+// UpdateFields stages an Update change which replaces the value at each field path rather
+// than deep merging maps. The document must already exist.
+func (s Stager) UpdateFields(docPath string, updates []FieldUpdate) error {
+	before, err := s.migrator.database.getDocData(docPath)
+	if err != nil {
+		return err
+	}
+	patch, err := fieldUpdatePatch(updates)
+	if err != nil {
+		return err
+	}
+	change := NewChange(docPath, before, patch, MigratorUpdateFields, s.migrator.database)
+	return s.stage(change)
+}
+
+// fieldUpdatePatch stores field updates as a flat patch keyed by field path string.
+func fieldUpdatePatch(updates []FieldUpdate) (map[string]any, error) {
+	patch := map[string]any{}
+	paths := [][]string{}
+	for _, u := range updates {
+		if len(u.Path) == 0 {
+			return nil, errors.New("Field update needs a path.")
+		}
+		patch[FieldChange{Path: u.Path}.PathString()] = u.Value
+		paths = append(paths, u.Path)
+	}
+	if err := checkFieldPaths(paths); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// checkFieldPaths refuses a path listed twice, or a path inside another listed path such as
+// a and a.b, since which value would win is ambiguous and Firestore rejects the write.
+func checkFieldPaths(paths [][]string) error {
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			if len(a) == len(b) && hasPathPrefix(a, b) {
+				return errors.New("Field path " + FieldChange{Path: a}.PathString() + " is listed twice.")
+			}
+			if hasPathPrefix(a, b) || hasPathPrefix(b, a) {
+				return errors.New("Field paths " + FieldChange{Path: a}.PathString() + " and " + FieldChange{Path: b}.PathString() + " overlap.")
+			}
+		}
+	}
+	return nil
+}
+
+// hasPathPrefix reports whether path starts with every segment of prefix.
+func hasPathPrefix(path []string, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, seg := range prefix {
+		if path[i] != seg {
+			return false
+		}
+	}
+	return true
+}
+
+// patchFieldUpdates returns the field updates of a flat field path patch ordered by path.
+func patchFieldUpdates(patch map[string]any) ([]FieldUpdate, error) {
+	keys := []string{}
+	for k := range patch {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	updates := []FieldUpdate{}
+	for _, k := range keys {
+		path, err := parseFieldPath(k)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, FieldUpdate{Path: path, Value: patch[k]})
+	}
+	return updates, nil
+}
+
+// parseFieldPath splits a field path string into segments. Segments may be quoted with
+// backticks, with \` escaping a backtick inside.
+func parseFieldPath(s string) ([]string, error) {
+	path := []string{}
+	var seg strings.Builder
+	quoted, escaped, closed := false, false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			seg.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '`':
+			quoted = !quoted
+			closed = !quoted
+		case !quoted && r == '.':
+			if seg.Len() == 0 && !closed {
+				return nil, errors.New("Invalid field path " + s + ".")
+			}
+			path = append(path, seg.String())
+			seg.Reset()
+			closed = false
+		default:
+			seg.WriteRune(r)
+		}
+	}
+	if quoted || (seg.Len() == 0 && !closed) {
+		return nil, errors.New("Invalid field path " + s + ".")
+	}
+	return append(path, seg.String()), nil
+}
+
+// applyFieldUpdates returns a copy of the document with each field update applied. A value
+// replaces the field wholesale, missing parent maps are created and delete sentinels remove
+// the field.
+func applyFieldUpdates(doc map[string]any, updates []FieldUpdate, f figFirestore) map[string]any {
+	after := cloneData(doc).(map[string]any)
+	for _, u := range updates {
+		parent := after
+		for _, seg := range u.Path[:len(u.Path)-1] {
+			next, ok := parent[seg].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				parent[seg] = next
+			}
+			parent = next
+		}
+		leaf := u.Path[len(u.Path)-1]
+		if isDeleteValue(u.Value, f) {
+			delete(parent, leaf)
+		} else {
+			parent[leaf] = u.Value
+		}
+	}
+	return after
+}
+
+// cloneData returns a deep copy of document data which shares no maps or arrays with it. Other
+// values are kept as they are, so fields which are not updated stay identical.
+func cloneData(data any) any {
+	if items, ok := data.([]any); ok {
+		out := make([]any, len(items))
+		for i, item := range items {
+			out[i] = cloneData(item)
+		}
+		return out
+	}
+	if data != nil && reflect.TypeOf(data).Kind() == reflect.Map {
+		out := map[string]any{}
+		for k, v := range toMapAny(data) {
+			out[k] = cloneData(v)
+		}
+		return out
+	}
+	return data
+}
+
+// SetMerge stages a Set change which writes only the listed field paths from data, leaving
+// the rest of the document untouched. Each field is a path string such as "a.b" or "`b.c`"
+// and must refer to a value in data. The value at each path replaces the old value outright.
+func (s Stager) SetMerge(docPath string, data map[string]any, fields ...string) error {
+	if len(fields) == 0 {
+		return errors.New("SetMerge needs at least one field path.")
+	}
+	paths := [][]string{}
+	for _, field := range fields {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	if err := checkFieldPaths(paths); err != nil {
+		return err
+	}
+	before, err := s.migrator.database.getDocData(docPath)
+	if err != nil {
+		return err
+	}
+	change := NewChange(docPath, before, data, MigratorSetMerge, s.migrator.database)
+	change.fields = paths
+	return s.stage(change)
+}
+
+// mergeFieldUpdates returns the field updates written by a merge of the listed paths.
+func mergeFieldUpdates(data map[string]any, paths [][]string) ([]FieldUpdate, error) {
+	updates := []FieldUpdate{}
+	for _, path := range paths {
+		v, ok := lookupPath(data, path)
+		if !ok {
+			return nil, errors.New("Merge field " + FieldChange{Path: path}.PathString() + " is not in the data.")
+		}
+		updates = append(updates, FieldUpdate{Path: path, Value: v})
+	}
+	return updates, nil
+}
+
+// lookupPath returns the value at a field path in nested document data.
+func lookupPath(data map[string]any, path []string) (any, bool) {
+	var v any = data
+	for _, seg := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// fieldPathStrings converts field paths to path strings for storage.
+func fieldPathStrings(paths [][]string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	fields := []string{}
+	for _, path := range paths {
+		fields = append(fields, FieldChange{Path: path}.PathString())
+	}
+	return fields
+}
@@ -11,11 +11,14 @@ import (
 	firebase "firebase.google.com/go"
 	"github.com/aidarkhanov/nanoid"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // figFirestore is an interface that expresses what a NoSQL database dependency should do.
 type figFirestore interface {
 	getDocData(docPath string) (map[string]any, error)
+	readDoc(docPath string) (map[string]any, bool, error)
 	genDocPath(colPath string) (string, error)
 	updateDoc(docPath string, data map[string]any) error
 	setDoc(docPath string, data map[string]any) error
@@ -25,8 +28,18 @@ type figFirestore interface {
 	name() string
 	getDocStruct(target any, docPath string) error
 	setDocStruct(target any, docPath string) error
+	listDocPaths(colPath string) ([]string, error)
+	listCollections(docPath string) ([]string, error)
+	updateFields(docPath string, updates []FieldUpdate) error
+	setMerge(docPath string, data map[string]any, fields [][]string) error
+	createDoc(docPath string, data map[string]any) error
+	transactDoc(docPath string, fn func(data map[string]any, exists bool) (map[string]any, error)) error
+	writeIf(docPath string, check func(data map[string]any, exists bool) error, command Command, data map[string]any, fields [][]string) error
 }
 
+// defaultDatabase is the ID of the database every Firestore project starts with.
+const defaultDatabase = "(default)"
+
 // fireFriend is the gofig implementation/wrapper for google's firestore client.
 type fireFriend struct {
 	client *firestore.Client
@@ -34,23 +47,32 @@ type fireFriend struct {
 	config map[string]string
 }
 
-// newFirestore is a fireFriend factory
-func newFirestore(keyPath string) (*fireFriend, func(), error) {
+// newFirestore is a fireFriend factory. An empty database selects the (default) database.
+func newFirestore(keyPath string, database string) (*fireFriend, func(), error) {
 
 	ctx := context.Background()
 
 	sa := option.WithCredentialsFile(keyPath)
 
-	app, err := firebase.NewApp(ctx, nil, sa)
-	if err != nil {
-		return nil, func() {}, err
+	var client *firestore.Client
+	if database == "" || database == defaultDatabase {
+		app, err := firebase.NewApp(ctx, nil, sa)
+		if err != nil {
+			return nil, func() {}, err
+		}
+		if client, err = app.Firestore(ctx); err != nil {
+			return nil, func() {}, err
+		}
+	} else {
+		// the project is read from the service account key
+		var err error
+		client, err = firestore.NewClientWithDatabase(ctx, firestore.DetectProjectID, database, sa)
+		if err != nil {
+			return nil, func() {}, err
+		}
 	}
-
-	client, err := app.Firestore(ctx)
-	alphabet := "abcdefghijklmnopqrstuvwxyz"
-	alphabet += strings.ToUpper(alphabet) + "0123456789_-"
 	config := map[string]string{
-		"idChars": alphabet,
+		"idChars": idAlphabet,
 		"idSize":  "20",
 	}
 
@@ -59,15 +81,55 @@ func newFirestore(keyPath string) (*fireFriend, func(), error) {
 		ctx,
 		config,
 	}
-	return &f, func() { client.Close() }, err
+	return &f, func() { client.Close() }, nil
 
 }
 
 // name returns a hash for the underlying firestore database name. This may
 // be useful for guarding against pushing changes to the wrong database.
+// The (default) database is named by its project alone, projects/<project>, and a
+// named database by projects/<project>/databases/<database>.
 func (f fireFriend) name() string {
-	s := strings.Split(f.client.Doc("__init__/__init__").Path, "__init__/__init__")[0]
-	return strings.Split(s, "/databases/(default)/documents/")[0]
+	path := f.client.Doc("__init__/__init__").Path
+	return databaseName(path[:strings.Index(path, "/documents/")])
+}
+
+// databaseName converts the resource path of a database to the name returned by
+// figFirestore.name.
+func databaseName(dbPath string) string {
+	return strings.TrimSuffix(dbPath, "/databases/"+defaultDatabase)
+}
+
+// databasePath converts a name returned by figFirestore.name to the resource path of the
+// database, projects/<project>/databases/<database>.
+func databasePath(name string) string {
+	if strings.Contains(name, "/databases/") {
+		return name
+	}
+	return name + "/databases/" + defaultDatabase
+}
+
+// refPath returns the path a document reference is serialized with. References into the
+// database f is connected to are relative, so a migration can be retargeted to another
+// environment. References into any other project or database keep their full resource path.
+func refPath(path string, f figFirestore) string {
+	i := strings.Index(path, "/documents/")
+	if i < 0 || path[:i] != databasePath(f.name()) {
+		return path
+	}
+	return path[i+len("/documents/"):]
+}
+
+// isResourcePath reports whether a serialized reference path is a full resource path
+// rather than a path relative to the connected database.
+func isResourcePath(path string) bool {
+	return strings.HasPrefix(path, "projects/") && strings.Contains(path, "/documents/")
+}
+
+// resourceRef returns a reference to the document at a full resource path, which may be in
+// another project or database. The reference can be written as a field value but not read.
+func resourceRef(path string) *firestore.DocumentRef {
+	return &firestore.DocumentRef{Path: path, ID: path[strings.LastIndex(path, "/")+1:]}
 }
 
 // docRef converts a string path to a firestore document reference.
@@ -112,6 +174,19 @@ func (f fireFriend) getDocData(docPath string) (map[string]any, error) {
 	return snap.Data(), nil
 }
 
+// readDoc reads the specified document and reports whether it exists, so an existing empty
+// document is told apart from a missing one.
+func (f fireFriend) readDoc(docPath string) (map[string]any, bool, error) {
+	snap, err := f.doc(docPath)
+	if status.Code(err) == codes.NotFound {
+		return map[string]any{}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return snap.Data(), true, nil
+}
+
 // setDocStruct writes the target data to the docPath location.
 func (f fireFriend) setDocStruct(target any, docPath string) error {
 	ref, err := f.docRef(docPath)
@@ -177,6 +252,45 @@ func (f fireFriend) updateDoc(docPath string, data map[string]any) error {
 	return err
 }
 
+// updateFields replaces the value at each field path of an existing document. Unlike
+// updateDoc, nested maps are replaced rather than merged.
+func (f fireFriend) updateFields(docPath string, updates []FieldUpdate) error {
+	ref, err := f.docRef(docPath)
+	if err != nil {
+		return err
+	}
+	_, err = ref.Update(f.ctx, firestoreUpdates(updates))
+	return err
+}
+
+// firestoreUpdates converts field updates to the firestore client's form.
+func firestoreUpdates(updates []FieldUpdate) []firestore.Update {
+	fsUpdates := []firestore.Update{}
+	for _, u := range updates {
+		fsUpdates = append(fsUpdates, firestore.Update{FieldPath: firestore.FieldPath(u.Path), Value: u.Value})
+	}
+	return fsUpdates
+}
+
+// firestorePaths converts field paths to the firestore client's form.
+func firestorePaths(fields [][]string) []firestore.FieldPath {
+	paths := []firestore.FieldPath{}
+	for _, field := range fields {
+		paths = append(paths, firestore.FieldPath(field))
+	}
+	return paths
+}
+
+// setMerge writes only the listed field paths of data to the document, creating it if needed.
+func (f fireFriend) setMerge(docPath string, data map[string]any, fields [][]string) error {
+	ref, err := f.docRef(docPath)
+	if err != nil {
+		return err
+	}
+	_, err = ref.Set(f.ctx, data, firestore.Merge(firestorePaths(fields)...))
+	return err
+}
+
 // setDoc pushes the data to the document at the given docPath. The document is overwritten.
 func (f fireFriend) setDoc(docPath string, data map[string]any) error {
 	ref, err := f.docRef(docPath)
@@ -188,6 +302,17 @@ func (f fireFriend) setDoc(docPath string, data map[string]any) error {
 	return err
 }
 
+// createDoc writes the data to a new document. It fails if the document already exists.
+func (f fireFriend) createDoc(docPath string, data map[string]any) error {
+	ref, err := f.docRef(docPath)
+
+	if err == nil {
+		_, err = ref.Create(f.ctx, data)
+	}
+
+	return err
+}
+
 // deleteDoc removed the given document from the database.
 func (f fireFriend) deleteDoc(docPath string) error {
 	ref, err := f.docRef(docPath)
@@ -199,11 +324,128 @@ func (f fireFriend) deleteDoc(docPath string) error {
 	return err
 }
 
+// listDocPaths returns the paths of the documents in the given collection.
+func (f fireFriend) listDocPaths(colPath string) ([]string, error) {
+	colRef := f.client.Collection(colPath)
+	if colRef == nil {
+		return nil, errors.New("Invalid collection path. Must have even number of path tokens.")
+	}
+	refs, err := colRef.DocumentRefs(f.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, ref := range refs {
+		paths = append(paths, colPath+"/"+ref.ID)
+	}
+	return paths, nil
+}
+
+// listCollections returns the paths of the subcollections of the given document.
+func (f fireFriend) listCollections(docPath string) ([]string, error) {
+	ref, err := f.docRef(docPath)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := ref.Collections(f.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, col := range cols {
+		paths = append(paths, docPath+"/"+col.ID)
+	}
+	return paths, nil
+}
+
+// transactDoc reads the document at docPath and writes the data returned by fn within a
+// transaction. If fn returns nil data the document is deleted. If fn errors nothing is written.
+func (f fireFriend) transactDoc(docPath string, fn func(data map[string]any, exists bool) (map[string]any, error)) error {
+	ref, err := f.docRef(docPath)
+	if err != nil {
+		return err
+	}
+
+	return f.client.RunTransaction(f.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		exists := err == nil && snap.Exists()
+		data := map[string]any{}
+		if exists {
+			data = snap.Data()
+		}
+
+		next, err := fn(data, exists)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			if exists {
+				return tx.Delete(ref)
+			}
+			return nil
+		}
+		return tx.Set(ref, next)
+	})
+}
+
+// writeIf reads the document at docPath and, if check passes, writes data with the semantics
+// of command within one transaction. If check errors nothing is written.
+func (f fireFriend) writeIf(docPath string, check func(data map[string]any, exists bool) error, command Command, data map[string]any, fields [][]string) error {
+	ref, err := f.docRef(docPath)
+	if err != nil {
+		return err
+	}
+
+	return f.client.RunTransaction(f.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		exists := err == nil && snap.Exists()
+		live := map[string]any{}
+		if exists {
+			live = snap.Data()
+		}
+		if err := check(live, exists); err != nil {
+			return err
+		}
+
+		switch command {
+		case MigratorUpdate:
+			return tx.Set(ref, data, firestore.MergeAll)
+		case MigratorUpdateFields:
+			updates, err := patchFieldUpdates(data)
+			if err != nil {
+				return err
+			}
+			return tx.Update(ref, firestoreUpdates(updates))
+		case MigratorSetMerge:
+			return tx.Set(ref, data, firestore.Merge(firestorePaths(fields)...))
+		case MigratorSet:
+			return tx.Set(ref, data)
+		case MigratorAdd:
+			return tx.Create(ref, data)
+		default:
+			return tx.Delete(ref)
+		}
+	})
+}
+
 func (f fireFriend) deleteField() any {
 	return firestore.Delete
 }
 
 func (f fireFriend) refField(docPath string) any {
+	if isResourcePath(docPath) {
+		dbPath := docPath[:strings.Index(docPath, "/documents/")]
+		if databaseName(dbPath) != f.name() {
+			return resourceRef(docPath)
+		}
+		docPath = docPath[len(dbPath)+len("/documents/"):]
+	}
 	ref, _ := f.docRef(docPath)
 	return ref
 }
@@ -1,9 +1,12 @@
 package fig
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 )
 
 // GoFig represents the main Fig API.
@@ -13,6 +16,22 @@ type GoFig interface {
 	LoadFromStorage() error
 	SaveToStorage() error
 	ManageStagedMigration()
+	Browse() error
+	ExportPlan(format string) ([]byte, error)
+	SetRenderer(format string, renderer PlanRenderer)
+	RegisterSchema(pattern string, schema Schema)
+	AddChangeRule(name string, rule ChangeRule)
+	AddMigrationRule(name string, rule MigrationRule)
+	BeforeRun(hook RunHook)
+	AfterChange(hook ChangeHook)
+	AfterRun(hook RunHook)
+	OnError(hook ErrorHook)
+	RestoreBackup(name string) error
+	Regenerate() error
+	Sync(source SyncSource, colPath string, recursive bool) error
+	ExportCollection(colPath string, path string, recursive bool) error
+	Import(path string, create bool) error
+	ForceUnlock() error
 	DeleteField() any
 	RefField(docPath string) any
 }
@@ -26,18 +45,85 @@ type Fig struct {
 
 // Config is the expected structure for Fig config
 type Config struct {
-	KeyPath     string
+	KeyPath string
+	// Database selects a named Firestore database. Defaults to the (default) database.
+	Database string
+	// StoragePath selects where migrations are kept: a local directory, file://dir,
+	// firestore://collection or s3://bucket/prefix?endpoint=...&region=...
 	StoragePath string
 	Name        string
+	// Store replaces the migration store selected by StoragePath.
+	Store MigrationStore
+	// HMACKey signs stored migrations with hmac-sha256 and verifies them on load.
+	HMACKey []byte
+	// SigningKey signs stored migrations with ed25519 and verifies them on load.
+	SigningKey ed25519.PrivateKey
+	// VerifyKey verifies ed25519 signed migrations when the private key is not available.
+	VerifyKey ed25519.PublicKey
+	// Environment labels the connected database, for example prod or staging.
+	Environment string
+	// Retarget allows a migration recorded against another database or environment to be loaded and run.
+	Retarget bool
+	// Rerun allows a migration which has already run to be run again.
+	Rerun bool
+	// Operator is recorded in the audit log as the person running migrations. Defaults to user@host.
+	Operator string
+	// ReviewChanges makes ManageStagedMigration walk through each change to accept, skip or
+	// edit it. Only accepted changes are run and rolled back.
+	ReviewChanges bool
+	// PlanFormats are saved next to the migration each time it is presented by
+	// ManageStagedMigration, or after the review with ReviewChanges. Built in formats are
+	// json, markdown, html and text.
+	PlanFormats []string
+	// PageThreshold is the number of changes above which ManageStagedMigration presents a
+	// summary and a pager instead of every diff. Defaults to 20. Negative disables the pager.
+	PageThreshold int
+	// LockTTL is how long the execution lock survives without a heartbeat. Defaults to two minutes.
+	LockTTL time.Duration
+	// AllowUnverified loads migrations even when their checksum or signature does not verify.
+	AllowUnverified bool
+	// AllowInvalid runs migrations even when changed documents violate their registered schemas.
+	AllowInvalid bool
+	// Verify reads back every document after a run and reports any that differ from the
+	// presented after values. The outcome is stored with the migration.
+	Verify bool
+	// Backup archives every targeted document, with the subcollections of deleted documents,
+	// to a timestamped backup in the storage path immediately before a run writes.
+	Backup bool
+	// IDSeed makes Add generate document IDs deterministically so re-staging reproduces the
+	// same migration. Random IDs are used when empty.
+	IDSeed string
+	// StagePolicy resolves a change staged for a document which already has one. Defaults to
+	// StageReplace so loading a migration and staging again, or re-running a staging script,
+	// is idempotent. StageCompose keeps every change and applies them in order.
+	StagePolicy StagePolicy
 }
 
+// defaultPageThreshold is the default Config.PageThreshold.
+const defaultPageThreshold = 20
+
 // New is a Fig factory. Defer *Fig.Close() after initialization.
 func New(config Config) (*Fig, error) {
-	ff, close, err := newFirestore(config.KeyPath)
+	ff, close, err := newFirestore(config.KeyPath, config.Database)
 	if err != nil {
 		return nil, err
 	}
 	mig := NewMigrator(config.StoragePath, ff, config.Name)
+	mig.SetIntegrityKeys(config.HMACKey, config.SigningKey, config.VerifyKey)
+	mig.SetAllowUnverified(config.AllowUnverified)
+	mig.SetEnvironment(config.Environment)
+	mig.SetRetarget(config.Retarget)
+	mig.SetRerun(config.Rerun)
+	mig.SetLockTTL(config.LockTTL)
+	mig.SetOperator(config.Operator)
+	mig.SetAllowInvalid(config.AllowInvalid)
+	mig.SetVerify(config.Verify)
+	mig.SetBackup(config.Backup)
+	mig.SetIDSeed(config.IDSeed)
+	mig.SetStagePolicy(config.StagePolicy)
+	if config.Store != nil {
+		mig.SetStore(config.Store)
+	}
 	c := Fig{
 		config: config,
 		mig:    mig,
@@ -81,14 +167,29 @@ func (c *Fig) SaveToStorage() error {
 func (c *Fig) ManageStagedMigration() {
 
 	clearTerm()
+	if c.config.ReviewChanges {
+		c.reviewAndPresent()
+		return
+	}
 	if err := c.prepAndPresent(false); err != nil {
 		fmt.Println("PrepError: " + err.Error())
 		return
 	}
+	c.savePlan()
 	c.promptRun()
 
 }
 
+// Browse launches the full screen browser for the migrations in the storagePath location. Stored
+// migrations can be reviewed change by change, run and rolled back. When stdout is not a
+// terminal the migrations are listed as plain output instead.
+func (c *Fig) Browse() error {
+	if err := c.mig.Browse(os.Stdin, os.Stdout); err != nil {
+		return errors.New("BrowseError: " + err.Error())
+	}
+	return nil
+}
+
 // prepAndPresent is a script to prepare the migration and present it via stdout.
 func (c *Fig) prepAndPresent(clear bool) error {
 	if clear {
@@ -97,10 +198,57 @@ func (c *Fig) prepAndPresent(clear bool) error {
 	if err := c.mig.PrepMigration(); err != nil {
 		return err
 	}
+	if c.paged() {
+		c.mig.PresentSummary()
+		fmt.Println("Review changes in the pager? (Y/n):")
+		userConfirm := "Y"
+		fmt.Scanln(&userConfirm)
+		if strings.ToLower(userConfirm) != "n" {
+			c.mig.PageMigration(os.Stdin, os.Stdout)
+		}
+		return nil
+	}
 	c.mig.PresentMigration()
 	return nil
 }
 
+// reviewAndPresent is a script to walk the user through each change for approval, then
+// present what was accepted and prompt to run it.
+func (c *Fig) reviewAndPresent() {
+	if err := c.mig.PrepMigration(); err != nil {
+		fmt.Println("PrepError: " + err.Error())
+		return
+	}
+	c.mig.PresentSummary()
+	result := c.mig.ReviewMigration(os.Stdin, os.Stdout)
+	fmt.Print(separator(40) + result.Present())
+	c.savePlan()
+	if len(result.Accepted) == 0 {
+		fmt.Println("No changes applied.")
+		return
+	}
+	c.promptRun()
+}
+
+// savePlan writes the plan files configured in PlanFormats for the migration as it will run.
+func (c *Fig) savePlan() {
+	if len(c.config.PlanFormats) == 0 {
+		return
+	}
+	if err := c.mig.SavePlan(c.config.PlanFormats...); err != nil {
+		fmt.Println("PlanError: " + err.Error())
+	}
+}
+
+// paged reports whether the staged migration is large enough to be reviewed in the pager.
+func (c *Fig) paged() bool {
+	threshold := c.config.PageThreshold
+	if threshold == 0 {
+		threshold = defaultPageThreshold
+	}
+	return threshold > 0 && c.mig.changeCount() > threshold
+}
+
 // promptRun is a script to prompt a user for confirmation. If the user confirms
 // in the affirmative, the migration is run against the database.
 func (c *Fig) promptRun() {
@@ -110,13 +258,139 @@ func (c *Fig) promptRun() {
 
 	if strings.ToLower(userConfirm) == "y" {
 		fmt.Println("Running migration...")
-		c.mig.RunMigration()
-		fmt.Println("Complete.")
+		report, err := c.mig.RunMigration()
+		if err != nil {
+			fmt.Println("RunError: " + err.Error())
+			return
+		}
+		fmt.Printf("Complete. %d applied, %d skipped, %d failed.\n", report.appliedCount(), len(report.Skipped()), len(report.Failed()))
+		if report.Backup != "" {
+			fmt.Println("Backup: " + report.Backup)
+		}
+		if report.Verification != nil {
+			fmt.Print(report.Verification.Present())
+		}
 	} else {
 		fmt.Println("No changes applied.")
 	}
 }
 
+// ExportPlan prepares the staged migration and renders it in the given format, one of
+// json, markdown, html, text or a format added with SetRenderer.
+func (c *Fig) ExportPlan(format string) ([]byte, error) {
+	if err := c.mig.PrepMigration(); err != nil {
+		return nil, err
+	}
+	return c.mig.RenderMigration(format)
+}
+
+// SetRenderer adds or replaces the plan renderer used by ExportPlan for a format.
+func (c *Fig) SetRenderer(format string, renderer PlanRenderer) {
+	c.mig.SetRenderer(format, renderer)
+}
+
+// RegisterSchema validates the after value of every staged document whose path matches the
+// pattern, for example users/* or users/*/orders/*. Use NewJSONSchema or NewStructSchema.
+func (c *Fig) RegisterSchema(pattern string, schema Schema) {
+	c.mig.RegisterSchema(pattern, schema)
+}
+
+// AddChangeRule registers a policy rule run against each staged change. Rules return warnings
+// or blocking errors, for example fig.ForbidDelete("users/*").
+func (c *Fig) AddChangeRule(name string, rule ChangeRule) {
+	c.mig.AddChangeRule(name, rule)
+}
+
+// AddMigrationRule registers a policy rule run against the whole migration, for example
+// fig.MaxChanges(1000).
+func (c *Fig) AddMigrationRule(name string, rule MigrationRule) {
+	c.mig.AddMigrationRule(name, rule)
+}
+
+// BeforeRun registers a hook called before a migration pushes any change. An error from the
+// hook aborts the run.
+func (c *Fig) BeforeRun(hook RunHook) {
+	c.mig.BeforeRun(hook)
+}
+
+// AfterChange registers a hook called after each change is pushed.
+func (c *Fig) AfterChange(hook ChangeHook) {
+	c.mig.AfterChange(hook)
+}
+
+// AfterRun registers a hook called with the report of a finished run, for example
+// fig.Webhook(url) to notify a channel.
+func (c *Fig) AfterRun(hook RunHook) {
+	c.mig.AfterRun(hook)
+}
+
+// OnError registers a hook called for every error during a run.
+func (c *Fig) OnError(hook ErrorHook) {
+	c.mig.OnError(hook)
+}
+
+// Regenerate reads every before value again from the live database and solves every change
+// again. Call it after LoadFromStorage so an old migration shows an accurate diff.
+func (c *Fig) Regenerate() error {
+	if err := c.mig.Regenerate(); err != nil {
+		return errors.New("RegenerateError: " + err.Error())
+	}
+	return nil
+}
+
+// Sync stages the changes which make a collection match the source, another database opened
+// with NewDatabaseSource or an export read with LoadExport. The result is a normal migration
+// which can be presented, stored, run and rolled back.
+func (c *Fig) Sync(source SyncSource, colPath string, recursive bool) error {
+	if err := c.mig.Sync(source, colPath, recursive); err != nil {
+		return errors.New("SyncError: " + err.Error())
+	}
+	return nil
+}
+
+// ExportCollection writes every document of a collection, and with recursive of its
+// subcollections, to a json file at path. Values use the same encoding as migration files.
+func (c *Fig) ExportCollection(colPath string, path string, recursive bool) error {
+	e, err := c.mig.ExportCollection(colPath, recursive)
+	if err == nil {
+		err = e.Save(path)
+	}
+	if err != nil {
+		return errors.New("ExportError: " + err.Error())
+	}
+	return nil
+}
+
+// Import stages every document of the export at path as a Set, or as an Add with create.
+// The staged migration is managed like any other.
+func (c *Fig) Import(path string, create bool) error {
+	e, err := LoadExport(path)
+	if err == nil {
+		err = c.mig.Import(e, create)
+	}
+	if err != nil {
+		return errors.New("ImportError: " + err.Error())
+	}
+	return nil
+}
+
+// RestoreBackup writes every document in the named backup back exactly as it was when the
+// backup was taken. Backups are named <migration>_backup_<timestamp>.
+func (c *Fig) RestoreBackup(name string) error {
+	if err := c.mig.RestoreBackup(name); err != nil {
+		return errors.New("RestoreError: " + err.Error())
+	}
+	return nil
+}
+
+// ForceUnlock clears a stale execution lock left behind by a run that did not exit cleanly.
+func (c *Fig) ForceUnlock() error {
+	if err := c.mig.ForceUnlock(); err != nil {
+		return errors.New("UnlockError: " + err.Error())
+	}
+	return nil
+}
+
 // DeleteField is a shortcut to the controlled database DeleteField.
 func (c *Fig) DeleteField() any {
 	return c.mig.deleteField()
@@ -1,9 +1,27 @@
 package fig
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
 )
 
 // <----------------------------------------- Mock ------------------------------------------->
@@ -34,12 +52,37 @@ func (f MockFirestore) refField(docPath string) any {
 func (f MockFirestore) name() string {
 	return ""
 }
+func (f MockFirestore) readDoc(docPath string) (map[string]any, bool, error) {
+	return map[string]any{}, false, nil
+}
 func (f MockFirestore) getDocStruct(target any, docPath string) error {
 	return nil
 }
 func (f MockFirestore) setDocStruct(target any, docPath string) error {
 	return nil
 }
+func (f MockFirestore) listDocPaths(colPath string) ([]string, error) {
+	return []string{}, nil
+}
+func (f MockFirestore) listCollections(docPath string) ([]string, error) {
+	return []string{}, nil
+}
+func (f MockFirestore) updateFields(docPath string, updates []FieldUpdate) error {
+	return nil
+}
+func (f MockFirestore) setMerge(docPath string, data map[string]any, fields [][]string) error {
+	return nil
+}
+func (f MockFirestore) createDoc(docPath string, data map[string]any) error {
+	return nil
+}
+func (f MockFirestore) transactDoc(docPath string, fn func(data map[string]any, exists bool) (map[string]any, error)) error {
+	_, err := fn(map[string]any{}, false)
+	return err
+}
+func (f MockFirestore) writeIf(docPath string, check func(data map[string]any, exists bool) error, command Command, data map[string]any, fields [][]string) error {
+	return check(map[string]any{}, false)
+}
 
 var mf MockFirestore = MockFirestore{}
 
@@ -174,3 +217,1651 @@ func TestChanges(t *testing.T) {
 	}
 
 }
+
+// TestIntegrity verifies sealed migrations load and tampered migrations are refused.
+func TestIntegrity(t *testing.T) {
+	mig := Migration{
+		DatabaseName: "projects/test",
+		ChangeUnits:  []WorkUnit{{DocPath: "test/test", Patch: map[string]any{"a": "foo"}, Command: MigratorSet}},
+	}
+	_, signKey, _ := ed25519.GenerateKey(nil)
+	keys := map[string]integrity{
+		"none":    {},
+		"hmac":    {hmacKey: []byte("secret")},
+		"ed25519": {signKey: signKey},
+	}
+
+	for k, i := range keys {
+		sealed := mig
+		if err := i.seal(&sealed); err != nil {
+			t.Fatalf("Unable to seal on %s", k)
+		}
+		if err := i.verify(sealed); err != nil {
+			t.Fatalf("Sealed migration did not verify on %s: %s", k, err.Error())
+		}
+		sealed.ChangeUnits = []WorkUnit{{DocPath: "test/other", Command: MigratorDelete}}
+		if err := i.verify(sealed); err == nil {
+			t.Fatalf("Tampered migration verified on %s", k)
+		}
+		i.allowUnverified = true
+		if err := i.verify(sealed); err != nil {
+			t.Fatalf("Override was not honored on %s", k)
+		}
+	}
+
+	if err := keys["hmac"].verify(mig); err == nil {
+		t.Fatalf("Unsealed migration verified with a key configured")
+	}
+	if err := keys["none"].verify(mig); err != nil {
+		t.Fatalf("Unsealed migration refused without a key configured")
+	}
+	legacy := mig
+	legacy.ChangeUnits = []WorkUnit{{DocPath: "test/test", Patch: map[string]any{"a": []any{}}, Command: MigratorSet}}
+	digest, _ := legacyDigest(legacy)
+	legacy.Checksum = hex.EncodeToString(digest)
+	if err := keys["none"].verify(legacy); err != nil {
+		t.Fatalf("Migration sealed by an older version refused: %s", err.Error())
+	}
+}
+
+// storedFirestore is a memoryFirestore which keeps structs the way Firestore returns them, with
+// timestamps in UTC to the microsecond.
+type storedFirestore struct {
+	memoryFirestore
+	structs map[string][]byte
+}
+
+func (f storedFirestore) setDocStruct(target any, docPath string) error {
+	js, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	var content any
+	json.Unmarshal(js, &content)
+	var stored func(v any) any
+	stored = func(v any) any {
+		switch t := v.(type) {
+		case map[string]any:
+			for k, item := range t {
+				t[k] = stored(item)
+			}
+		case []any:
+			for i, item := range t {
+				t[i] = stored(item)
+			}
+		case string:
+			if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+				return ts.UTC().Truncate(time.Microsecond)
+			}
+		}
+		return v
+	}
+	f.structs[docPath], err = json.Marshal(stored(content))
+	return err
+}
+
+func (f storedFirestore) getDocStruct(target any, docPath string) error {
+	js, ok := f.structs[docPath]
+	if !ok {
+		return fmt.Errorf("%s not found", docPath)
+	}
+	return json.Unmarshal(js, target)
+}
+
+// TestStoredChecksum verifies a migration run with verification and large integers still
+// matches its checksum after a round trip through the Firestore store.
+func TestStoredChecksum(t *testing.T) {
+	mem := storedFirestore{memoryFirestore{docs: map[string]map[string]any{"users/a": {"n": int64(1)}}}, map[string][]byte{}}
+	m := NewMigrator("firestore://migrations", mem, "test")
+	m.SetVerify(true)
+	m.Stage().Update("users/a", map[string]any{"n": int64(1<<53 + 1)})
+	m.PrepMigration()
+	if _, err := m.RunMigration(); err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	if _, ok := mem.structs["migrations/test"]; !ok {
+		t.Fatalf("Migration was not stored")
+	}
+
+	loaded := NewMigrator("firestore://migrations", mem, "test")
+	if err := loaded.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	if loaded.verification == nil || !loaded.verification.Passed() {
+		t.Fatalf("Verification was not stored with the migration")
+	}
+}
+
+// TestCheckTarget verifies migrations recorded against another database or environment are refused.
+func TestCheckTarget(t *testing.T) {
+	m := NewMigrator("", mf, "test")
+	m.SetEnvironment("staging")
+
+	targets := map[string]migrationTarget{
+		"other_database":    {database: "projects/other"},
+		"other_environment": {environment: "prod"},
+	}
+	for k, v := range targets {
+		m.target = v
+		m.SetRetarget(false)
+		if err := m.checkTarget(); err == nil {
+			t.Fatalf("Mismatched target accepted on %s", k)
+		}
+		m.SetRetarget(true)
+		if err := m.checkTarget(); err != nil {
+			t.Fatalf("Retarget was not honored on %s", k)
+		}
+	}
+
+	m.SetRetarget(false)
+	m.target = migrationTarget{environment: "staging"}
+	if err := m.checkTarget(); err != nil {
+		t.Fatalf("Matching target refused")
+	}
+	m.SetEnvironment("")
+	if err := m.checkTarget(); err == nil {
+		t.Fatalf("Target environment accepted without an environment set")
+	}
+}
+
+// TestFileLease verifies the local execution lock refuses a second owner until it is released or stale.
+func TestFileLease(t *testing.T) {
+	store := FileStore{Dir: t.TempDir()}.leases()
+	now := time.Now()
+	first := lease{Owner: "first", Migration: "test", Expires: now.Add(time.Minute)}
+	second := lease{Owner: "second", Migration: "test", Expires: now.Add(time.Minute)}
+
+	if err := store.claimLease(first, now); err != nil {
+		t.Fatalf("Unable to claim free lock: %s", err.Error())
+	}
+	if err := store.claimLease(second, now); err == nil {
+		t.Fatalf("Claimed a lock held by another owner")
+	}
+	if err := store.releaseLease(second.Owner); err != nil {
+		t.Fatalf("Unable to release: %s", err.Error())
+	}
+	if err := store.claimLease(second, now); err == nil {
+		t.Fatalf("Another owner released the lock")
+	}
+	if err := store.claimLease(second, now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("Unable to take over stale lock: %s", err.Error())
+	}
+	if err := store.releaseLease(""); err != nil {
+		t.Fatalf("Unable to force unlock: %s", err.Error())
+	}
+	if err := store.claimLease(first, now); err != nil {
+		t.Fatalf("Unable to claim after force unlock: %s", err.Error())
+	}
+
+	path := store.(fileLease).path
+	os.WriteFile(path, []byte(`{"owner": "sec`), 0644)
+	if err := store.claimLease(second, now.Add(time.Hour)); err == nil {
+		t.Fatalf("Claimed an unreadable lock")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Unreadable lock was removed")
+	}
+	store.releaseLease("")
+	store.claimLease(first, now)
+	os.WriteFile(path+".guard", nil, 0644)
+	if err := store.claimLease(second, now.Add(time.Hour)); !errors.Is(err, errLockBusy) {
+		t.Fatalf("Took over a lock while it was guarded")
+	}
+	crashed := time.Now().Add(-2 * guardTTL)
+	os.Chtimes(path+".guard", crashed, crashed)
+	if err := store.claimLease(second, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Stale guard was not broken: %s", err.Error())
+	}
+	if _, err := os.Stat(path + ".guard"); !os.IsNotExist(err) {
+		t.Fatalf("Stale guard was left behind")
+	}
+
+	m := NewMigrator(t.TempDir(), mf, "test")
+	m.SetOperator("ann")
+	held, err := m.acquireLock()
+	if err != nil {
+		t.Fatalf("Unable to lock: %s", err.Error())
+	}
+	defer held.release()
+	if held.lease.Operator != "ann" || !strings.Contains(held.lease.lockedError().Error(), "held by ann (") {
+		t.Fatalf("Lock holder was not named by operator: %v", held.lease.lockedError())
+	}
+}
+
+// TestLostLock verifies a run stops writing once its lock is taken over and that a TTL too
+// short for the heartbeat is refused.
+func TestLostLock(t *testing.T) {
+	mem := memoryFirestore{docs: map[string]map[string]any{}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	m.SetLockTTL(30 * time.Millisecond)
+	m.Stage().Set("users/a", map[string]any{"a": "foo"})
+	m.Stage().Set("users/b", map[string]any{"b": "foo"})
+	m.PrepMigration()
+	m.AfterChange(func(c *Change, res ChangeResult) {
+		if c.docPath == "users/a" {
+			thief := lease{Owner: "thief", Expires: time.Now().Add(time.Hour)}
+			FileStore{Dir: m.storagePath}.leases().(fileLease).write(thief)
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	report, err := m.RunMigration()
+	if err == nil || len(report.Results) != 1 || mem.docs["users/b"] != nil {
+		t.Fatalf("Run continued after losing its lock %v", err)
+	}
+	rollback := NewMigrator(m.storagePath, mem, "test_rollback")
+	if err := rollback.LoadMigration(); err != nil || len(rollback.changes) != 1 {
+		t.Fatalf("Unrun changes were rolled back")
+	}
+
+	short := NewMigrator(t.TempDir(), mem, "short")
+	short.SetLockTTL(time.Nanosecond)
+	if _, err := short.RunMigration(); err == nil {
+		t.Fatalf("Lock TTL shorter than the minimum was accepted")
+	}
+}
+
+// fakeObjectServer is a minimal in memory S3 stand-in supporting conditional writes and listing.
+func fakeObjectServer() *httptest.Server {
+	objects := map[string][]byte{}
+	var mu sync.Mutex
+	etag := func(b []byte) string { return fmt.Sprintf(`"%x"`, sha256.Sum256(b)) }
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		body, exists := objects[key]
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("list-type") == "2" {
+				fmt.Fprint(w, "<ListBucketResult>")
+				for k := range objects {
+					rest := strings.TrimPrefix(k, r.URL.Query().Get("prefix"))
+					if strings.HasPrefix(k, r.URL.Query().Get("prefix")) && !strings.Contains(rest, "/") {
+						fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+					}
+				}
+				fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+				return
+			}
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", etag(body))
+			w.Write(body)
+		case http.MethodPut:
+			if (r.Header.Get("If-None-Match") == "*" && exists) ||
+				(r.Header.Get("If-Match") != "" && (!exists || r.Header.Get("If-Match") != etag(body))) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			objects[key], _ = io.ReadAll(r.Body)
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+// TestObjectStore verifies records and locks round trip through an S3 compatible store.
+func TestObjectStore(t *testing.T) {
+	server := fakeObjectServer()
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	store, err := openStore("s3://bucket/migrations?endpoint="+server.URL, mf)
+	if err != nil {
+		t.Fatalf("Unable to open store: %s", err.Error())
+	}
+
+	mig := Migration{DatabaseName: "projects/test", ChangeUnits: []WorkUnit{{DocPath: "test/test", Command: MigratorDelete}}}
+	if err := store.Save("first", mig); err != nil {
+		t.Fatalf("Unable to save: %s", err.Error())
+	}
+	var loaded Migration
+	if err := store.Load("first", &loaded); err != nil || !reflect.DeepEqual(loaded.ChangeUnits, mig.ChangeUnits) {
+		t.Fatalf("Mismatched load: %v", err)
+	}
+	names, err := store.List()
+	if err != nil || !reflect.DeepEqual(names, []string{"first"}) {
+		t.Fatalf("Mismatched list: %v %v", names, err)
+	}
+
+	leases := storeLeases(store)
+	now := time.Now()
+	if err := leases.claimLease(lease{Owner: "first", Expires: now.Add(time.Minute)}, now); err != nil {
+		t.Fatalf("Unable to claim free lock: %s", err.Error())
+	}
+	if err := leases.claimLease(lease{Owner: "second", Expires: now.Add(time.Minute)}, now); err == nil {
+		t.Fatalf("Claimed a lock held by another owner")
+	}
+	if err := leases.releaseLease("first"); err != nil {
+		t.Fatalf("Unable to release: %s", err.Error())
+	}
+
+	if err := store.Delete("first"); err != nil {
+		t.Fatalf("Unable to delete: %s", err.Error())
+	}
+	if err := store.Load("first", &loaded); err == nil {
+		t.Fatalf("Loaded a deleted record")
+	}
+}
+
+// TestAbbreviate verifies long arrays and strings are truncated without hiding differences.
+func TestAbbreviate(t *testing.T) {
+	long := []any{}
+	for i := 0; i < 50; i++ {
+		long = append(long, i)
+	}
+	changed := append(append([]any{}, long[:49]...), "x")
+	text := strings.Repeat("a", 200)
+
+	a := abbreviate(map[string]any{"list": long, "text": text}).(map[string]any)
+	b := abbreviate(map[string]any{"list": changed, "text": text + "b"}).(map[string]any)
+
+	if len(a["list"].([]any)) != maxPresentItems+1 {
+		t.Fatalf("Long array was not truncated")
+	}
+	if len(a["text"].(string)) >= len(text) {
+		t.Fatalf("Long string was not truncated")
+	}
+	if reflect.DeepEqual(a, b) {
+		t.Fatalf("Abbreviation hid a difference")
+	}
+}
+
+// TestPageMigration verifies the pager steps through, jumps between and expands changes.
+func TestPageMigration(t *testing.T) {
+	m := NewMigrator("", mf, "test")
+	for _, path := range []string{"users/a", "users/b", "orders/a"} {
+		m.Stage().Set(path, map[string]any{"a": strings.Repeat("a", 200)})
+	}
+	m.PrepMigration()
+
+	var out strings.Builder
+	m.PageMigration(strings.NewReader("n\ng orders\ne\nq\n"), &out)
+	pages := strings.Split(out.String(), "[ change ")
+	expect := []string{"1/3", "2/3", "3/3", "3/3"}
+	if len(pages) != len(expect)+1 {
+		t.Fatalf("Mismatched page count %d", len(pages)-1)
+	}
+	for i, e := range expect {
+		if !strings.HasPrefix(pages[i+1], e) {
+			t.Fatalf("Mismatched page %d, expected %s", i, e)
+		}
+	}
+	// Each page is printed before its status line, so the split puts it after the previous status.
+	if !strings.Contains(pages[2], "+120 chars") || strings.Contains(pages[3], "+120 chars") {
+		t.Fatalf("Expand did not show the full diff")
+	}
+}
+
+// TestRenderMigration verifies each built in plan format renders the staged changes.
+func TestRenderMigration(t *testing.T) {
+	m := NewMigrator(t.TempDir(), mf, "test")
+	m.Stage().Set("users/<a>", map[string]any{"name": "foo", "tags": []any{"x"}})
+	m.PrepMigration()
+
+	js, err := m.RenderMigration("json")
+	if err != nil {
+		t.Fatalf("Unable to render json: %s", err.Error())
+	}
+	var plan Plan
+	if err := json.Unmarshal(js, &plan); err != nil || len(plan.Changes) != 1 || len(plan.Changes[0].Fields) != 2 {
+		t.Fatalf("Mismatched json plan: %s", string(js))
+	}
+
+	for format, expect := range map[string]string{"markdown": "### `users/<a>` SET", "html": "users/&lt;a&gt;", "text": "+ name"} {
+		out, err := m.RenderMigration(format)
+		if err != nil || !strings.Contains(string(out), expect) {
+			t.Fatalf("Mismatched %s plan: %s", format, string(out))
+		}
+	}
+
+	if err := m.SavePlan("markdown", "html"); err != nil {
+		t.Fatalf("Unable to save plan: %s", err.Error())
+	}
+	if _, err := m.RenderMigration("pdf"); err == nil {
+		t.Fatalf("Rendered an unknown format")
+	}
+
+	ticks := NewMigrator(t.TempDir(), mf, "test")
+	ticks.Stage().Set("users/b", map[string]any{"a|b": "run `x` | ``y``", "code": "```sh\nls\n```"})
+	ticks.PrepMigration()
+	md, err := ticks.RenderMigration("markdown")
+	if err != nil {
+		t.Fatalf("Unable to render markdown: %s", err.Error())
+	}
+	for _, expect := range []string{"| `` `a\\|b` `` | added |", "| ```\"run `x` \\| ``y``\"``` |", "````json"} {
+		if !strings.Contains(string(md), expect) {
+			t.Fatalf("Backticks were not fenced, missing %s in %s", expect, string(md))
+		}
+	}
+}
+
+// TestDiffData verifies field level changes are solved with Firestore value semantics.
+func TestDiffData(t *testing.T) {
+	now := time.Now()
+	b := map[string]any{
+		"same":    7,
+		"time":    now,
+		"gone":    "foo",
+		"flip":    "1",
+		"nested":  map[string]any{"a": 1, "b": 2},
+		"list":    []any{1, 2},
+		"a.b":     true,
+		"changed": "foo",
+	}
+	a := map[string]any{
+		"same":    7.0,
+		"time":    now.UTC(),
+		"flip":    1,
+		"nested":  map[string]any{"a": 1, "b": 3},
+		"list":    []any{1, 2, 3},
+		"a.b":     false,
+		"changed": "bar",
+		"new":     nil,
+	}
+	expect := map[string]DiffKind{
+		"`a.b`":    DiffModified,
+		"changed":  DiffModified,
+		"flip":     DiffTypeChanged,
+		"gone":     DiffRemoved,
+		"list.2":   DiffAdded,
+		"nested.b": DiffModified,
+		"new":      DiffAdded,
+	}
+
+	changes := diffData(b, a, mf)
+	if len(changes) != len(expect) {
+		t.Fatalf("Mismatched change count %d: %v", len(changes), changes)
+	}
+	for _, fc := range changes {
+		kind, ok := expect[fc.PathString()]
+		if !ok || kind != fc.Kind {
+			t.Fatalf("Mismatched change on %s: %s", fc.PathString(), fc.Kind)
+		}
+	}
+}
+
+// TestReviewMigration verifies skipped changes are removed and edits are solved again.
+func TestReviewMigration(t *testing.T) {
+	m := NewMigrator("", mf, "test")
+	for _, path := range []string{"users/a", "users/b", "users/c", "orders/a", "orders/b", "posts/a"} {
+		m.Stage().Set(path, map[string]any{"a": "foo"})
+	}
+	m.PrepMigration()
+
+	var out strings.Builder
+	in := strings.NewReader("e\n{\"a\":\"bar\"}\na\ns\ns\nc\nq\n")
+	result := m.ReviewMigration(in, &out)
+
+	if !reflect.DeepEqual(result.Accepted, []string{"users/a", "orders/a", "orders/b"}) {
+		t.Fatalf("Mismatched accepted %v", result.Accepted)
+	}
+	if !reflect.DeepEqual(result.Skipped, []string{"users/b", "users/c", "posts/a"}) {
+		t.Fatalf("Mismatched skipped %v", result.Skipped)
+	}
+	if len(m.changes) != 3 || m.changes[0].after["a"] != "bar" {
+		t.Fatalf("Edit was not applied")
+	}
+}
+
+// TestReviewSavesPlan verifies the configured plan files are saved after a per-change review.
+func TestReviewSavesPlan(t *testing.T) {
+	dir := t.TempDir()
+	fg := &Fig{mig: NewMigrator(dir, mf, "test"), config: Config{ReviewChanges: true, PlanFormats: []string{"json"}}}
+	fg.mig.Stage().Set("users/a", map[string]any{"a": "foo"})
+	fg.mig.Stage().Set("users/b", map[string]any{"b": "foo"})
+
+	r, w, _ := os.Pipe()
+	w.WriteString("a\ns\nN\n")
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	fg.ManageStagedMigration()
+
+	var plan Plan
+	content, err := os.ReadFile(filepath.Join(dir, "test_plan.json"))
+	if err != nil {
+		t.Fatalf("Plan was not saved after review: %s", err.Error())
+	}
+	json.Unmarshal(content, &plan)
+	if len(plan.Changes) != 1 || plan.Changes[0].DocPath != "users/a" {
+		t.Fatalf("Saved plan is not the reviewed one %v", plan.Changes)
+	}
+}
+
+// TestBrowse verifies stored migrations are listed plainly off a terminal and can be opened on one.
+func TestBrowse(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMigrator(dir, mf, "first")
+	m.Stage().Set("users/a", map[string]any{"a": "foo"})
+	m.PrepMigration()
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+
+	var plain strings.Builder
+	if err := m.Browse(strings.NewReader(""), &plain); err != nil {
+		t.Fatalf("Unable to browse: %s", err.Error())
+	}
+	if !strings.Contains(plain.String(), "first") || strings.Contains(plain.String(), termAltScreen) {
+		t.Fatalf("Mismatched plain listing: %s", plain.String())
+	}
+
+	var screen strings.Builder
+	other := NewMigrator(dir, mf, "other")
+	other.Stage().Update("users/b", map[string]any{"b": "bar"})
+	other.PrepMigration()
+	b := newBrowser(other, strings.NewReader("1\n1\nb\nb\nq\n"), &screen, true)
+	if err := b.run(); err != nil {
+		t.Fatalf("Unable to run browser: %s", err.Error())
+	}
+	for _, expect := range []string{"users/", "BEFORE", `"a": "foo"`, termMainScreen} {
+		if !strings.Contains(screen.String(), expect) {
+			t.Fatalf("Browser did not show %s", expect)
+		}
+	}
+	if other.name != "other" || len(other.changes) != 1 || other.changes[0].docPath != "users/b" || other.hasRun {
+		t.Fatalf("Browser replaced the staged migration")
+	}
+
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/a": {"n": 1}}}
+	done := NewMigrator(t.TempDir(), mem, "done")
+	done.Stage().Update("users/a", map[string]any{"n": 2})
+	done.PrepMigration()
+	if _, err := done.RunMigration(); err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	if _, err := done.RunMigration(); err == nil {
+		t.Fatalf("Migration which has already run was run again")
+	}
+	mem.docs["users/a"] = map[string]any{"n": 5}
+	b = newBrowser(done, strings.NewReader("1\nrun\nyes\nb\nq\n"), io.Discard, true)
+	b.run()
+	if mem.docs["users/a"]["n"] != 5 {
+		t.Fatalf("Browser ran an executed migration without a re-run confirmation")
+	}
+	b = newBrowser(done, strings.NewReader("1\nrun\nrerun\n\nb\nq\n"), io.Discard, true)
+	b.run()
+	if toFloat(mem.docs["users/a"]["n"]) != 2 {
+		t.Fatalf("Browser did not re-run after confirmation")
+	}
+}
+
+// TestSchemas verifies documents are validated against the schemas matching their paths and
+// invalid migrations are refused unless allowed.
+func TestSchemas(t *testing.T) {
+	for pattern, expect := range map[string]bool{"users/*": true, "users/*/orders/*": false, "**": true, "posts/*": false} {
+		if matchPath(pattern, "users/a") != expect {
+			t.Fatalf("Mismatched match of %s", pattern)
+		}
+	}
+
+	js, err := NewJSONSchema([]byte(`{
+		"type": "object",
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 2},
+			"age": {"type": "integer", "minimum": 0},
+			"joined": {"type": "string", "format": "date-time"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Unable to parse schema: %s", err.Error())
+	}
+	type user struct {
+		Name   string    `firestore:"name"`
+		Age    int       `firestore:"age"`
+		Joined time.Time `firestore:"joined,omitempty"`
+	}
+	st, err := NewStructSchema(user{})
+	if err != nil {
+		t.Fatalf("Unable to build schema: %s", err.Error())
+	}
+
+	valid := map[string]any{"name": "ann", "age": 30, "joined": time.Now()}
+	invalid := map[string]any{"name": "a", "age": 1.5, "extra": true}
+	for name, s := range map[string]Schema{"json": js, "struct": st} {
+		if v := s.Validate(valid); len(v) != 0 {
+			t.Fatalf("Valid document refused by %s schema: %v", name, v)
+		}
+		paths := []string{}
+		for _, v := range s.Validate(invalid) {
+			paths = append(paths, v.Path)
+		}
+		if !reflect.DeepEqual(paths, map[string][]string{"json": {"age", "extra", "name"}, "struct": {"age", "extra"}}[name]) {
+			t.Fatalf("Mismatched %s violations %v", name, paths)
+		}
+	}
+
+	m := NewMigrator(t.TempDir(), mf, "test")
+	m.RegisterSchema("users/*", js)
+	m.Stage().Set("users/a", invalid)
+	m.Stage().Set("posts/a", invalid)
+	m.PrepMigration()
+	if len(m.changes[0].violations) == 0 || len(m.changes[1].violations) != 0 {
+		t.Fatalf("Schemas were not applied by path")
+	}
+	if _, err := m.RunMigration(); err == nil {
+		t.Fatalf("Invalid migration was run")
+	}
+	m.SetAllowInvalid(true)
+	if _, err := m.RunMigration(); err != nil {
+		t.Fatalf("Allowed invalid migration was refused: %s", err.Error())
+	}
+
+	mem := deletingFirestore{memoryFirestore{docs: map[string]map[string]any{
+		"users/a": {"name": "ann", "age": int64(30), "joined": "2023-05-13T13:44:40Z"},
+	}}}
+	d := NewMigrator(t.TempDir(), mem, "test")
+	d.RegisterSchema("users/*", js)
+	d.Stage().Update("users/a", map[string]any{"joined": firestore.Delete})
+	d.PrepMigration()
+	if len(d.changes[0].violations) != 0 {
+		t.Fatalf("Deleted optional field was reported %v", d.changes[0].violations)
+	}
+	d.Stage().Update("users/a", map[string]any{"age": firestore.Delete})
+	d.PrepMigration()
+	if len(d.changes[0].violations) != 1 || d.changes[0].violations[0].Path != "age" {
+		t.Fatalf("Deleted required field was not reported %v", d.changes[0].violations)
+	}
+
+	edited := NewMigrator(t.TempDir(), mem, "test")
+	edited.RegisterSchema("users/*", js)
+	edited.Stage().Set("users/a", map[string]any{"name": "bob", "age": 31})
+	edited.PrepMigration()
+	edited.ReviewMigration(strings.NewReader("e\n{\"age\":31}\na\n"), io.Discard)
+	if len(edited.changes[0].violations) == 0 {
+		t.Fatalf("Edited change was not validated")
+	}
+	edited.changes[0].violations = nil
+	if _, err := edited.RunMigration(); err == nil || mem.docs["users/a"]["name"] != "ann" {
+		t.Fatalf("Edited change which breaks its schema was run")
+	}
+}
+
+// deletingFirestore is a memoryFirestore whose delete sentinel is the firestore client's.
+type deletingFirestore struct {
+	memoryFirestore
+}
+
+func (f deletingFirestore) deleteField() any {
+	return firestore.Delete
+}
+
+// TestPolicies verifies rule findings are recorded and only blocking findings stop a run.
+func TestPolicies(t *testing.T) {
+	m := NewMigrator(t.TempDir(), mf, "test")
+	m.AddChangeRule("no-user-deletes", ForbidDelete("users/*"))
+	m.AddChangeRule("keep-createdAt", ForbidFieldRemoval("createdAt"))
+	m.AddMigrationRule("max-changes", MaxChanges(1))
+	m.AddChangeRule("billing", func(c *Change) []Finding {
+		if matchPath("billing/*", c.DocPath()) {
+			return []Finding{Warn("billing needs a second approver")}
+		}
+		return nil
+	})
+	m.Stage().Delete("users/a")
+	m.Stage().Set("billing/a", map[string]any{"a": "foo"})
+	m.PrepMigration()
+
+	rules := []string{}
+	for _, f := range m.Findings() {
+		rules = append(rules, fmt.Sprintf("%s:%s", f.Rule, f.Severity))
+	}
+	if !reflect.DeepEqual(rules, []string{"no-user-deletes:error", "max-changes:error", "billing:warning"}) {
+		t.Fatalf("Mismatched findings %v", rules)
+	}
+	if !strings.Contains(m.renderSummary(), "billing needs a second approver") {
+		t.Fatalf("Findings were not presented")
+	}
+	if _, err := m.RunMigration(); err == nil {
+		t.Fatalf("Blocked migration was run")
+	}
+
+	m.policies = m.policies[3:]
+	m.PrepMigration()
+	if _, err := m.RunMigration(); err != nil {
+		t.Fatalf("Migration with only warnings was refused: %s", err.Error())
+	}
+
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/a": {"a": 1, "z": 1}}}
+	edited := NewMigrator(t.TempDir(), mem, "test")
+	edited.AddChangeRule("keep-a", ForbidFieldRemoval("a"))
+	edited.Stage().Set("users/a", map[string]any{"a": 2, "z": 1})
+	edited.PrepMigration()
+	edited.ReviewMigration(strings.NewReader("e\n{\"z\":1}\na\n"), io.Discard)
+	if len(edited.Findings()) != 1 {
+		t.Fatalf("Edited change was not checked against the rules")
+	}
+	edited.findings = nil
+	if _, err := edited.RunMigration(); err == nil || !reflect.DeepEqual(mem.docs["users/a"], map[string]any{"a": 1, "z": 1}) {
+		t.Fatalf("Edited change which breaks a rule was run")
+	}
+}
+
+// failingFirestore fails every write.
+type failingFirestore struct{ MockFirestore }
+
+func (f failingFirestore) setDoc(docPath string, data map[string]any) error {
+	return fmt.Errorf("write refused")
+}
+
+// TestHooks verifies lifecycle hooks run in order, a failing BeforeRun aborts the run and
+// change failures reach OnError.
+func TestHooks(t *testing.T) {
+	var posted RunReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer server.Close()
+
+	calls := []string{}
+	m := NewMigrator(t.TempDir(), failingFirestore{}, "test")
+	m.BeforeRun(func(report *RunReport) error {
+		calls = append(calls, "before")
+		return nil
+	})
+	m.AfterChange(func(c *Change, result ChangeResult) {
+		calls = append(calls, "change:"+string(result.Status))
+	})
+	m.OnError(func(report *RunReport, err error) {
+		calls = append(calls, "error")
+	})
+	m.AfterRun(func(report *RunReport) error {
+		calls = append(calls, "after")
+		return nil
+	})
+	m.AfterRun(Webhook(server.URL))
+	m.Stage().Set("users/a", map[string]any{"a": "foo"})
+	m.PrepMigration()
+
+	if _, err := m.RunMigration(); err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	if !reflect.DeepEqual(calls, []string{"before", "error", "change:failed", "after"}) {
+		t.Fatalf("Mismatched hook calls %v", calls)
+	}
+	if posted.Migration != "test" || len(posted.Results) != 1 {
+		t.Fatalf("Webhook did not receive the report")
+	}
+
+	calls = []string{}
+	m.SetRerun(true)
+	m.BeforeRun(func(report *RunReport) error {
+		return fmt.Errorf("maintenance flag unavailable")
+	})
+	if _, err := m.RunMigration(); err == nil || !reflect.DeepEqual(calls, []string{"before", "error"}) {
+		t.Fatalf("Failing BeforeRun did not abort the run: %v", calls)
+	}
+}
+
+// TestAudit verifies every run appends a report holding the plan hash and the outcome of
+// each change to the audit log.
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMigrator(dir, failingFirestore{}, "test")
+	m.SetOperator("ann")
+	m.SetRerun(true)
+	m.Stage().Set("users/a", map[string]any{"a": "foo"})
+	m.Stage().Set("users/b", map[string]any{"b": "foo"})
+	m.PrepMigration()
+	hash, err := m.planHash()
+	if err != nil {
+		t.Fatalf("Unable to hash the plan: %s", err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := m.RunMigration(); err != nil {
+			t.Fatalf("Unable to run: %s", err.Error())
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, auditName+".jsonl"))
+	if err != nil {
+		t.Fatalf("Unable to read the audit log: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a record per run, found %d", len(lines))
+	}
+	var report RunReport
+	if err := json.Unmarshal([]byte(lines[1]), &report); err != nil {
+		t.Fatalf("Unable to parse the audit record: %s", err.Error())
+	}
+	if report.Migration != "test" || report.Operator != "ann" || report.PlanHash != hash || report.Started.IsZero() {
+		t.Fatalf("Mismatched audit record %v", report)
+	}
+	failed := report.Failed()
+	if len(report.Results) != 2 || len(failed) != 2 || failed[0].DocPath != "users/a" || failed[1].Error != "write refused" {
+		t.Fatalf("Mismatched audit results %v", report.Results)
+	}
+}
+
+// TestPresentedPlan verifies a run refuses once the staged changes differ from the plan
+// presented, and records the presented plan hash in the audit log.
+func TestPresentedPlan(t *testing.T) {
+	dir := t.TempDir()
+	mem := memoryFirestore{docs: map[string]map[string]any{}}
+	m := NewMigrator(dir, mem, "test")
+	m.Stage().Set("users/a", map[string]any{"a": "foo"})
+	m.PrepMigration()
+	header := m.renderHeader()
+	m.Stage().Set("users/b", map[string]any{"b": "foo"})
+	m.PrepMigration()
+	if _, err := m.RunMigration(); err == nil || len(mem.docs) != 0 {
+		t.Fatalf("Ran a plan which differs from the one presented")
+	}
+
+	if err := m.SavePlan("json"); err != nil {
+		t.Fatalf("Unable to save plan: %s", err.Error())
+	}
+	report, err := m.RunMigration()
+	if err != nil {
+		t.Fatalf("Unable to run the presented plan: %s", err.Error())
+	}
+	if report.PlanHash != m.presented || strings.Contains(header, report.PlanHash) {
+		t.Fatalf("Run was not tied to the presented plan")
+	}
+}
+
+// memoryFirestore keeps documents in memory. Writes replace the document with the patch, so
+// updates lose unpatched fields and verification can catch the divergence.
+type memoryFirestore struct {
+	MockFirestore
+	docs map[string]map[string]any
+}
+
+func (f memoryFirestore) getDocData(docPath string) (map[string]any, error) {
+	if doc, ok := f.docs[docPath]; ok {
+		return doc, nil
+	}
+	return map[string]any{}, nil
+}
+func (f memoryFirestore) readDoc(docPath string) (map[string]any, bool, error) {
+	doc, ok := f.docs[docPath]
+	if !ok {
+		return map[string]any{}, false, nil
+	}
+	return doc, true, nil
+}
+func (f memoryFirestore) setDoc(docPath string, data map[string]any) error {
+	f.docs[docPath] = data
+	return nil
+}
+func (f memoryFirestore) updateDoc(docPath string, data map[string]any) error {
+	f.docs[docPath] = mergeMaps(f.docs[docPath], data)
+	return nil
+}
+func (f memoryFirestore) setMerge(docPath string, data map[string]any, fields [][]string) error {
+	updates, err := mergeFieldUpdates(data, fields)
+	if err == nil {
+		f.docs[docPath] = applyFieldUpdates(f.docs[docPath], updates, f)
+	}
+	return err
+}
+func (f memoryFirestore) writeIf(docPath string, check func(data map[string]any, exists bool) error, command Command, data map[string]any, fields [][]string) error {
+	doc, exists := f.docs[docPath]
+	if !exists {
+		doc = map[string]any{}
+	}
+	if err := check(doc, exists); err != nil {
+		return err
+	}
+	switch command {
+	case MigratorUpdate:
+		return f.updateDoc(docPath, data)
+	case MigratorUpdateFields:
+		updates, err := patchFieldUpdates(data)
+		if err != nil {
+			return err
+		}
+		return f.updateFields(docPath, updates)
+	case MigratorSetMerge:
+		return f.setMerge(docPath, data, fields)
+	case MigratorSet:
+		return f.setDoc(docPath, data)
+	case MigratorAdd:
+		return f.createDoc(docPath, data)
+	default:
+		return f.deleteDoc(docPath)
+	}
+}
+func (f memoryFirestore) updateFields(docPath string, updates []FieldUpdate) error {
+	f.docs[docPath] = applyFieldUpdates(f.docs[docPath], updates, f)
+	return nil
+}
+func (f memoryFirestore) deleteDoc(docPath string) error {
+	delete(f.docs, docPath)
+	return nil
+}
+func (f memoryFirestore) createDoc(docPath string, data map[string]any) error {
+	if _, ok := f.docs[docPath]; ok {
+		return fmt.Errorf("%s already exists", docPath)
+	}
+	f.docs[docPath] = data
+	return nil
+}
+func (f memoryFirestore) transactDoc(docPath string, fn func(data map[string]any, exists bool) (map[string]any, error)) error {
+	doc, exists := f.docs[docPath]
+	if !exists {
+		doc = map[string]any{}
+	}
+	next, err := fn(doc, exists)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		delete(f.docs, docPath)
+	} else {
+		f.docs[docPath] = next
+	}
+	return nil
+}
+func (f memoryFirestore) listDocPaths(colPath string) ([]string, error) {
+	return f.children(colPath), nil
+}
+func (f memoryFirestore) listCollections(docPath string) ([]string, error) {
+	return f.children(docPath), nil
+}
+
+// children returns the sorted paths one segment below parent which lead to a document.
+func (f memoryFirestore) children(parent string) []string {
+	found := map[string]bool{}
+	for path := range f.docs {
+		if rest := strings.TrimPrefix(path, parent+"/"); rest != path {
+			found[parent+"/"+strings.Split(rest, "/")[0]] = true
+		}
+	}
+	paths := []string{}
+	for p := range found {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// TestVerify verifies documents are read back after a run and mismatches are stored with the migration.
+func TestVerify(t *testing.T) {
+	at := time.Date(2023, 5, 13, 13, 44, 40, 522123000, time.UTC)
+	mem := memoryFirestore{docs: map[string]map[string]any{
+		"users/b": {"a": "foo", "b": "bar", "at": at},
+		"users/c": {"at": at},
+	}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	m.SetVerify(true)
+	m.Stage().Set("users/a", map[string]any{"a": "foo"})
+	m.Stage().Update("users/b", map[string]any{"a": "far"})
+	m.Stage().Update("users/c", map[string]any{"n": 1})
+	m.PrepMigration()
+	// another writer removes a field and moves a timestamp while the migration runs, and a
+	// timestamp below the stored precision is not a difference
+	m.AfterChange(func(c *Change, res ChangeResult) {
+		switch c.docPath {
+		case "users/b":
+			delete(mem.docs["users/b"], "b")
+			mem.docs["users/b"]["at"] = at.Add(100 * time.Nanosecond)
+		case "users/c":
+			mem.docs["users/c"]["at"] = at.Add(time.Microsecond)
+		}
+	})
+
+	report, err := m.RunMigration()
+	if err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	v := report.Verification
+	if v == nil || v.Checked != 3 || len(v.Mismatches) != 2 || v.Mismatches[0].DocPath != "users/b" {
+		t.Fatalf("Mismatched verification %+v", v)
+	}
+	if len(v.Mismatches[0].Fields) != 1 || v.Mismatches[0].Fields[0].PathString() != "b" || v.Mismatches[0].Fields[0].Kind != DiffAdded {
+		t.Fatalf("Mismatched fields %+v", v.Mismatches[0].Fields)
+	}
+	moved := v.Mismatches[1].Fields
+	if len(moved) != 1 || moved[0].Old != "<time>2023-05-13T13:44:40.522124Z<time>" || moved[0].New != "<time>2023-05-13T13:44:40.522123Z<time>" {
+		t.Fatalf("Mismatched timestamp fields %+v", moved)
+	}
+
+	loaded := NewMigrator(m.storagePath, mem, "test")
+	if err := loaded.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	if loaded.verification == nil || loaded.verification.Passed() {
+		t.Fatalf("Verification was not stored with the migration")
+	}
+}
+
+// TestBackup verifies a run archives targeted documents with the subcollections of deletes and
+// a restore replays the backup exactly.
+func TestBackup(t *testing.T) {
+	placed := time.Date(2023, 5, 13, 13, 44, 40, 522123456, time.UTC)
+	mem := memoryFirestore{docs: map[string]map[string]any{
+		"users/a":          {"a": "foo"},
+		"users/a/orders/x": {"total": int64(5), "placed": placed, "lines": []any{map[string]any{"price": 2.5, "qty": int64(2)}}, "note": nil},
+		"users/b":          {"b": "bar"},
+		"users/e":          {},
+	}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	m.SetBackup(true)
+	m.Stage().Delete("users/a")
+	m.Stage().Set("users/b", map[string]any{"b": "baz"})
+	m.Stage().Set("users/e", map[string]any{"e": "new"})
+	m.Stage().Set("users/c", map[string]any{"c": "new"})
+	m.PrepMigration()
+
+	report, err := m.RunMigration()
+	if err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	if !strings.HasPrefix(report.Backup, "test"+backupTag) {
+		t.Fatalf("Mismatched backup name %s", report.Backup)
+	}
+	delete(mem.docs, "users/a/orders/x")
+
+	if err := m.RestoreBackup(report.Backup); err != nil {
+		t.Fatalf("Unable to restore: %s", err.Error())
+	}
+	expect := map[string]map[string]any{
+		"users/a":          {"a": "foo"},
+		"users/a/orders/x": {"total": int64(5), "placed": placed, "lines": []any{map[string]any{"price": 2.5, "qty": int64(2)}}, "note": nil},
+		"users/b":          {"b": "bar"},
+		"users/e":          {},
+	}
+	if !reflect.DeepEqual(mem.docs, expect) {
+		t.Fatalf("Mismatched restore %v", mem.docs)
+	}
+
+	failing := NewMigrator(m.storagePath, failingFirestore{}, "test")
+	err = failing.RestoreBackup(report.Backup)
+	if err == nil || !strings.Contains(err.Error(), "users/b: write refused") {
+		t.Fatalf("Restore errors were not returned: %v", err)
+	}
+
+	again, err := m.takeBackup()
+	if err != nil || again == report.Backup {
+		t.Fatalf("Backups of the same migration collided %s", again)
+	}
+}
+
+// TestStageStruct verifies structs are encoded with firestore tag semantics.
+func TestStageStruct(t *testing.T) {
+	type audit struct {
+		Created time.Time `firestore:"created,serverTimestamp"`
+	}
+	type profile struct {
+		audit
+		Name    string            `firestore:"name"`
+		Age     int               `firestore:"age,omitempty"`
+		Tags    []string          `firestore:"tags,omitempty"`
+		Meta    map[string]uint16 `firestore:"meta"`
+		Secret  string            `firestore:"-"`
+		Renamed bool
+		hidden  string
+	}
+
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/a": {"name": "old", "age": int64(3)}}}
+	m := NewMigrator("", mem, "test")
+	stage := NewStage[profile](m.Stage())
+	if err := stage.Set("users/a", profile{Name: "ann", Meta: map[string]uint16{"n": 1}, Secret: "x", hidden: "y"}); err != nil {
+		t.Fatalf("Unable to stage: %s", err.Error())
+	}
+	if err := m.Stage().SetStruct("users/b", map[string]any{}); err == nil {
+		t.Fatalf("Staged a non struct")
+	}
+	m.PrepMigration()
+
+	c := m.changes[0]
+	expect := map[string]any{
+		"created": firestore.ServerTimestamp,
+		"name":    "ann",
+		"meta":    map[string]any{"n": int64(1)},
+		"Renamed": false,
+	}
+	if !reflect.DeepEqual(c.after, expect) {
+		t.Fatalf("Mismatched encoding %v", c.after)
+	}
+	kinds := map[string]DiffKind{}
+	for _, fc := range c.Diff() {
+		kinds[fc.PathString()] = fc.Kind
+	}
+	if kinds["name"] != DiffModified || kinds["age"] != DiffRemoved || kinds["created"] != DiffAdded {
+		t.Fatalf("Diff was not computed against the live document %v", kinds)
+	}
+
+	sCreated := serializeData(c.after, mf).(map[string]any)["created"]
+	if sCreated != serverTimestampMarker || !isServerTimestamp(deSerializeData(sCreated, mf)) {
+		t.Fatalf("Server timestamp did not survive serialization")
+	}
+}
+
+// TestUpdateFields verifies field path updates replace nested maps wholesale, target dotted
+// keys and survive storage.
+func TestUpdateFields(t *testing.T) {
+	for s, expect := range map[string][]string{"a.b": {"a", "b"}, "`b.c`": {"b.c"}, "a.`x\\`y`": {"a", "x`y"}, "``": {""}} {
+		path, err := parseFieldPath(s)
+		if err != nil || !reflect.DeepEqual(path, expect) {
+			t.Fatalf("Mismatched parse of %s: %v", s, path)
+		}
+		if p, _ := parseFieldPath(FieldChange{Path: expect}.PathString()); !reflect.DeepEqual(p, expect) {
+			t.Fatalf("Path string of %v did not round trip", expect)
+		}
+	}
+	for _, s := range []string{"", "a..b", "a.`b"} {
+		if _, err := parseFieldPath(s); err == nil {
+			t.Fatalf("Invalid path %s accepted", s)
+		}
+	}
+
+	at := time.Date(2023, 5, 13, 13, 44, 40, 522123000, time.UTC)
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/a": {"a": map[string]any{"x": 1, "y": 2}, "b.c": 1, "at": at}}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	m.Stage().UpdateFields("users/a", []FieldUpdate{
+		{Path: []string{"a"}, Value: map[string]any{"z": 3}},
+		{Path: []string{"b.c"}, Value: 2},
+		{Path: []string{"d", "e"}, Value: true},
+	})
+	m.Stage().UpdateFields("users/missing", []FieldUpdate{{Path: []string{"a"}, Value: 1}})
+	m.PrepMigration()
+
+	c := m.changes[0]
+	expect := map[string]any{"a": map[string]any{"z": 3}, "b.c": 2, "d": map[string]any{"e": true}, "at": at}
+	if !reflect.DeepEqual(c.after, expect) || c.commandString() != "updateFields" {
+		t.Fatalf("Mismatched after %v", c.after)
+	}
+	if !reflect.DeepEqual(c.rollback, mem.docs["users/a"]) {
+		t.Fatalf("Mismatched rollback %v", c.rollback)
+	}
+	for _, fc := range c.diff {
+		if fc.PathString() == "at" {
+			t.Fatalf("Untouched timestamp was changed %v", fc)
+		}
+	}
+	if m.changes[1].errState == nil {
+		t.Fatalf("Field update of a missing document was accepted")
+	}
+	for _, updates := range [][]FieldUpdate{
+		{{Path: []string{"a"}, Value: 1}, {Path: []string{"a"}, Value: 2}},
+		{{Path: []string{"a"}, Value: 1}, {Path: []string{"a", "x"}, Value: 2}},
+	} {
+		if err := m.Stage().UpdateFields("users/a", updates); err == nil || len(m.changes) != 2 {
+			t.Fatalf("Conflicting field paths %v were accepted", updates)
+		}
+	}
+
+	m.changes = m.changes[:1]
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+	if err := m.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	if m.changes[0].command != MigratorUpdateFields || len(m.changes[0].patch) != 3 {
+		t.Fatalf("Field updates were not restored")
+	}
+}
+
+// TestSetMerge verifies only the listed fields are merged and the fields survive storage.
+func TestSetMerge(t *testing.T) {
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/a": {"a": map[string]any{"x": 1, "y": 2}, "b": 1, "c": 1}}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	data := map[string]any{"a": map[string]any{"x": 5}, "b": 2, "c": 9}
+	m.Stage().SetMerge("users/a", data, "a.x", "b")
+	m.Stage().SetMerge("users/new", data, "c")
+	m.Stage().SetMerge("users/bad", data, "d")
+	m.PrepMigration()
+
+	expect := map[string]any{"a": map[string]any{"x": 5, "y": 2}, "b": 2, "c": 1}
+	if !reflect.DeepEqual(m.changes[0].after, expect) {
+		t.Fatalf("Mismatched after %v", m.changes[0].after)
+	}
+	if !reflect.DeepEqual(m.changes[1].after, map[string]any{"c": 9}) {
+		t.Fatalf("Mismatched after of new document %v", m.changes[1].after)
+	}
+	if m.changes[2].errState == nil {
+		t.Fatalf("Merge field missing from the data was accepted")
+	}
+	for _, fields := range [][]string{{"b", "b"}, {"a.x", "a"}} {
+		if err := m.Stage().SetMerge("users/a", data, fields...); err == nil || len(m.changes) != 3 {
+			t.Fatalf("Conflicting merge fields %v were accepted", fields)
+		}
+	}
+
+	m.changes = m.changes[:2]
+	rollback, _ := m.buildRollback()
+	if rollback.ChangeUnits[0].Command != MigratorSet || rollback.ChangeUnits[1].Command != MigratorDelete {
+		t.Fatalf("Mismatched rollback commands")
+	}
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+	if err := m.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	m.PrepMigration()
+	if m.changes[0].command != MigratorSetMerge || !reflect.DeepEqual(fieldPathStrings(m.changes[0].fields), []string{"a.x", "b"}) {
+		t.Fatalf("Merge fields were not restored")
+	}
+}
+
+// TestConditions verifies preconditions are stored, presented and skip changes that do not hold.
+func TestConditions(t *testing.T) {
+	mem := memoryFirestore{docs: map[string]map[string]any{
+		"users/a": {"status": "pending", "n": 1},
+		"users/b": {"status": "done"},
+		"users/d": {"status": "done"},
+	}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	pending := m.Stage().When(IfFieldEquals("status", "pending"))
+	pending.Update("users/a", map[string]any{"status": "active"})
+	pending.Update("users/b", map[string]any{"status": "active"})
+	m.Stage().When(IfNotExists()).Set("users/c", map[string]any{"status": "new"})
+	m.Stage().When(IfNotExists()).Set("users/d", map[string]any{"status": "new"})
+	m.PrepMigration()
+
+	if _, out := m.changes[0].Present(); !strings.Contains(out, `Only if: status == "pending"`) {
+		t.Fatalf("Condition was not presented: %s", out)
+	}
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+	if err := m.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	m.PrepMigration()
+
+	report, err := m.RunMigration()
+	if err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	statuses := []ChangeStatus{}
+	for _, res := range report.Results {
+		statuses = append(statuses, res.Status)
+	}
+	if !reflect.DeepEqual(statuses, []ChangeStatus{ChangeApplied, ChangeSkipped, ChangeApplied, ChangeSkipped}) {
+		t.Fatalf("Mismatched statuses %v", statuses)
+	}
+	if !reflect.DeepEqual(mem.docs["users/a"], map[string]any{"status": "active", "n": 1}) || mem.docs["users/b"]["status"] != "done" {
+		t.Fatalf("Mismatched documents %v", mem.docs)
+	}
+
+	rollback := NewMigrator(m.storagePath, mem, "test_rollback")
+	if err := rollback.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load rollback: %s", err.Error())
+	}
+	if len(rollback.changes) != 2 {
+		t.Fatalf("Skipped changes were rolled back")
+	}
+}
+
+// TestAdd verifies Add creates documents, detects collisions, keeps its identity through
+// storage and generates reproducible IDs from a seed.
+func TestAdd(t *testing.T) {
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/taken": {"a": "foo"}}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	m.SetIDSeed("seed")
+	m.Stage().Add("users", map[string]any{"a": "one"})
+	m.Stage().Add("users", map[string]any{"a": "two"})
+	m.Stage().AddWithID("users", "ann", map[string]any{"a": "ann"})
+	m.Stage().AddWithID("users", "taken", map[string]any{"a": "bar"})
+	m.PrepMigration()
+
+	first, second := m.changes[0].docPath, m.changes[1].docPath
+	if first == second || len(strings.TrimPrefix(first, "users/")) != idSize {
+		t.Fatalf("Mismatched seeded paths %s %s", first, second)
+	}
+	again := NewMigrator("", mem, "test")
+	again.SetIDSeed("seed")
+	again.Stage().Add("users", map[string]any{})
+	if again.changes[0].docPath != first {
+		t.Fatalf("Seeded ID was not reproduced")
+	}
+	if m.changes[2].docPath != "users/ann" || m.changes[3].errState == nil {
+		t.Fatalf("Collision on a caller ID was not detected")
+	}
+
+	m.changes = m.changes[:3]
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+	if err := m.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	m.PrepMigration()
+	for _, c := range m.changes {
+		if c.command != MigratorAdd {
+			t.Fatalf("Add was reloaded as %s", c.commandString())
+		}
+	}
+	if _, err := m.RunMigration(); err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	mem.docs[first] = map[string]any{"a": "changed"}
+	m.SetRerun(true)
+	report, _ := m.RunMigration()
+	if len(report.Failed()) != 3 || mem.docs[first]["a"] != "changed" {
+		t.Fatalf("Add overwrote existing documents")
+	}
+}
+
+// TestRestage verifies each stage policy and that Regenerate refreshes before values from
+// the live database.
+func TestRestage(t *testing.T) {
+	mem := memoryFirestore{docs: map[string]map[string]any{"users/a": {"a": "foo", "m": map[string]any{"x": 1}}}}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	for i := 0; i < 2; i++ {
+		m.Stage().Update("users/a", map[string]any{"a": "bar"})
+		m.Stage().Set("users/b", map[string]any{"b": "foo"})
+	}
+	if len(m.changes) != 2 || m.changes[0].docPath != "users/a" {
+		t.Fatalf("Re-staging was not idempotent %d", len(m.changes))
+	}
+	if m.PrepMigration(); len(m.Findings()) != 0 {
+		t.Fatalf("Identical re-staging raised findings %v", m.Findings())
+	}
+	replace := NewMigrator(t.TempDir(), mem, "test")
+	replace.Stage().Update("users/a", map[string]any{"a": "bar"})
+	replace.Stage().Update("users/a", map[string]any{"m": map[string]any{"x": 2}})
+	replace.PrepMigration()
+	findings := replace.Findings()
+	if len(replace.changes) != 1 || len(findings) != 1 || findings[0].DocPath != "users/a" || findings[0].Severity != SeverityWarning {
+		t.Fatalf("Replaced change was not reported %v", findings)
+	}
+	if out := replace.renderFindings(); !strings.Contains(out, "stage-replace") {
+		t.Fatalf("Replaced change was not presented: %s", out)
+	}
+
+	m.SetStagePolicy(StageError)
+	if err := m.Stage().Delete("users/a"); err == nil || len(m.changes) != 2 {
+		t.Fatalf("Duplicate change was not refused")
+	}
+
+	m.SetStagePolicy(StageMergePatches)
+	m.Stage().Update("users/a", map[string]any{"m": map[string]any{"y": 2}})
+	m.Stage().Update("users/b", map[string]any{"c": "bar"})
+	if err := m.PrepMigration(); err != nil {
+		t.Fatalf("Unable to prep: %s", err.Error())
+	}
+	if !reflect.DeepEqual(m.changes[0].patch, map[string]any{"a": "bar", "m": map[string]any{"y": 2}}) {
+		t.Fatalf("Mismatched merged patch %v", m.changes[0].patch)
+	}
+	if m.changes[1].command != MigratorSet || !reflect.DeepEqual(m.changes[1].after, map[string]any{"b": "foo", "c": "bar"}) {
+		t.Fatalf("Update was not merged into set %v", m.changes[1].after)
+	}
+
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+	mem.docs["users/a"] = map[string]any{"a": "baz"}
+	if err := m.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	mem.docs["users/a"] = map[string]any{"a": "bar"}
+	if err := m.Regenerate(); err != nil {
+		t.Fatalf("Unable to regenerate: %s", err.Error())
+	}
+	if m.changes[0].before["a"] != "bar" || len(m.changes[0].diff) != 1 || m.changes[0].diff[0].Kind != DiffAdded {
+		t.Fatalf("Before was not regenerated %v %v", m.changes[0].before, m.changes[0].diff)
+	}
+
+	del := deletingFirestore{memoryFirestore{docs: map[string]map[string]any{}}}
+	m = NewMigrator(t.TempDir(), del, "test")
+	m.SetStagePolicy(StageMergePatches)
+	m.Stage().Set("users/c", map[string]any{"a": "foo", "b": "foo", "m": map[string]any{"x": 1, "y": 2}})
+	m.Stage().Update("users/c", map[string]any{"b": del.deleteField(), "m": map[string]any{"y": del.deleteField()}})
+	if err := m.PrepMigration(); err != nil {
+		t.Fatalf("Unable to prep: %s", err.Error())
+	}
+	if m.changes[0].command != MigratorSet || !reflect.DeepEqual(m.changes[0].patch, map[string]any{"a": "foo", "m": map[string]any{"x": 1}}) {
+		t.Fatalf("Delete was not merged into set %v", m.changes[0].patch)
+	}
+}
+
+// TestCompose verifies changes on one document are composed in order and rolled back last
+// step first.
+func TestCompose(t *testing.T) {
+	mem := memoryFirestore{docs: map[string]map[string]any{
+		"users/a": {"a": "foo", "b": "foo"},
+		"users/b": {"a": "foo"},
+	}}
+	original := map[string]map[string]any{"users/a": mem.docs["users/a"], "users/b": mem.docs["users/b"]}
+	m := NewMigrator(t.TempDir(), mem, "test")
+	m.SetStagePolicy(StageCompose)
+	m.Stage().Set("users/a", map[string]any{"a": "bar", "b": "foo"})
+	m.Stage().Delete("users/b")
+	m.Stage().UpdateFields("users/a", []FieldUpdate{{Path: []string{"c"}, Value: "baz"}})
+	m.Stage().AddWithID("users", "b", map[string]any{"a": "new"})
+	if err := m.PrepMigration(); err != nil {
+		t.Fatalf("Unable to prep: %s", err.Error())
+	}
+	for _, c := range m.changes {
+		if c.errState != nil {
+			t.Fatalf("Composed change in error state %s", c.errState.Error())
+		}
+	}
+	if m.changes[2].before["a"] != "bar" || m.changes[2].step != 2 || len(m.changes[2].net) != 2 {
+		t.Fatalf("Changes were not composed %v %v", m.changes[2].before, m.changes[2].net)
+	}
+	if _, out := m.changes[2].Present(); !strings.Contains(out, "NET CHANGE OVER 2 STEPS") {
+		t.Fatalf("Net change was not presented: %s", out)
+	}
+
+	if err := m.StoreMigration(); err != nil {
+		t.Fatalf("Unable to store: %s", err.Error())
+	}
+	m.SetStagePolicy(StageReplace)
+	if err := m.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load: %s", err.Error())
+	}
+	if len(m.changes) != 4 {
+		t.Fatalf("Composed changes were not all loaded")
+	}
+	m.SetVerify(true)
+	m.PrepMigration()
+	report, err := m.RunMigration()
+	if err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	if len(report.Failed()) > 0 || !report.Verification.Passed() || report.Verification.Checked != 2 {
+		t.Fatalf("Composed run did not verify %v", report.Verification)
+	}
+	if mem.docs["users/a"]["c"] != "baz" || mem.docs["users/b"]["a"] != "new" {
+		t.Fatalf("Mismatched documents %v", mem.docs)
+	}
+
+	rollback := NewMigrator(m.storagePath, mem, "test_rollback")
+	if err := rollback.LoadMigration(); err != nil {
+		t.Fatalf("Unable to load rollback: %s", err.Error())
+	}
+	rollback.PrepMigration()
+	if _, err := rollback.RunMigration(); err != nil {
+		t.Fatalf("Unable to run rollback: %s", err.Error())
+	}
+	if !reflect.DeepEqual(mem.docs["users/a"], original["users/a"]) || !reflect.DeepEqual(mem.docs["users/b"], original["users/b"]) {
+		t.Fatalf("Rollback did not restore documents %v", mem.docs)
+	}
+}
+
+// refFirestore is a MockFirestore connected to the (default) database of project p which
+// builds document references.
+type refFirestore struct {
+	MockFirestore
+}
+
+func (f refFirestore) name() string {
+	return "projects/p"
+}
+func (f refFirestore) refField(docPath string) any {
+	if isResourcePath(docPath) {
+		return resourceRef(docPath)
+	}
+	return resourceRef("projects/p/databases/(default)/documents/" + docPath)
+}
+
+// TestReferences verifies references keep the project and database they point to through
+// serialization.
+func TestReferences(t *testing.T) {
+	f := refFirestore{}
+	data := map[string]any{
+		"local":   resourceRef("projects/p/databases/(default)/documents/users/a"),
+		"named":   resourceRef("projects/p/databases/archive/documents/users/a"),
+		"project": resourceRef("projects/q/databases/(default)/documents/users/a"),
+	}
+	s := serializeData(data, f).(map[string]any)
+	expect := map[string]any{
+		"local":   "<ref>users/a<ref>",
+		"named":   "<ref>projects/p/databases/archive/documents/users/a<ref>",
+		"project": "<ref>projects/q/databases/(default)/documents/users/a<ref>",
+	}
+	if !reflect.DeepEqual(s, expect) {
+		t.Fatalf("Mismatched serialized references %v", s)
+	}
+	if !reflect.DeepEqual(deSerializeData(s, f), data) {
+		t.Fatalf("References did not round trip")
+	}
+	if databaseName("projects/p/databases/archive") != "projects/p/databases/archive" || databasePath("projects/p") != "projects/p/databases/(default)" {
+		t.Fatalf("Mismatched database names")
+	}
+}
+
+// TestSync verifies a sync stages the changes which make a collection match another database
+// or an export.
+func TestSync(t *testing.T) {
+	source := memoryFirestore{docs: map[string]map[string]any{
+		"flags/a":         {"on": true, "n": int64(1)},
+		"flags/b":         {"on": true},
+		"flags/c":         {"on": false},
+		"flags/c/rules/x": {"min": int64(2)},
+		"other/z":         {"on": true},
+	}}
+	target := memoryFirestore{docs: map[string]map[string]any{
+		"flags/a":         {"on": false, "n": int64(1)},
+		"flags/b":         {"on": true, "old": "x"},
+		"flags/c":         {"on": false},
+		"flags/c/rules/y": {"min": int64(3)},
+		"flags/d":         {"on": true},
+	}}
+	m := NewMigrator(t.TempDir(), target, "test")
+	if err := m.Sync(databaseSource{source}, "flags", false); err != nil {
+		t.Fatalf("Unable to sync: %s", err.Error())
+	}
+	m.PrepMigration()
+	got := []string{}
+	for _, c := range m.changes {
+		got = append(got, c.docPath+" "+c.commandString())
+	}
+	if !reflect.DeepEqual(got, []string{"flags/a update", "flags/b set", "flags/d delete"}) {
+		t.Fatalf("Mismatched sync changes %v", got)
+	}
+	if !reflect.DeepEqual(m.changes[0].patch, map[string]any{"on": true}) {
+		t.Fatalf("Mismatched update patch %v", m.changes[0].patch)
+	}
+
+	docs, _ := collectDocs(source, "flags", true)
+	export := &Export{Collection: "flags", Recursive: true, Documents: docs}
+	content, _ := json.Marshal(export)
+	path := filepath.Join(t.TempDir(), "flags.json")
+	os.WriteFile(path, content, 0644)
+	loaded, err := LoadExport(path)
+	if err != nil {
+		t.Fatalf("Unable to load export: %s", err.Error())
+	}
+	r := NewMigrator(t.TempDir(), target, "test")
+	if err := r.Sync(loaded, "flags", true); err != nil {
+		t.Fatalf("Unable to sync: %s", err.Error())
+	}
+	got = []string{}
+	for _, c := range r.changes {
+		got = append(got, c.docPath+" "+c.commandString())
+	}
+	expect := []string{"flags/a update", "flags/b set", "flags/c/rules/x set", "flags/c/rules/y delete", "flags/d delete"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Mismatched recursive sync changes %v", got)
+	}
+}
+
+// TestExport verifies an exported collection imports into another database as Sets or Adds,
+// with every value keeping its type.
+func TestExport(t *testing.T) {
+	at := time.Date(2023, 5, 13, 13, 44, 40, 522123456, time.UTC)
+	source := memoryFirestore{docs: map[string]map[string]any{
+		"plans/a":         {"price": int64(5), "big": int64(1<<53 + 1), "at": at},
+		"plans/a/tiers/x": {"n": 1.0},
+		"other/z":         {"on": true},
+	}}
+	e, err := NewMigrator("", source, "test").ExportCollection("plans", true)
+	if err != nil {
+		t.Fatalf("Unable to export: %s", err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "plans.json")
+	if err := e.Save(path); err != nil {
+		t.Fatalf("Unable to save export: %s", err.Error())
+	}
+	loaded, err := LoadExport(path)
+	if err != nil || len(loaded.Documents) != 2 || !reflect.DeepEqual(loaded.Documents[0].Data["map"].(map[string]any)["price"], map[string]any{"integer": "5"}) {
+		t.Fatalf("Mismatched export %v %v", loaded, err)
+	}
+
+	target := memoryFirestore{docs: map[string]map[string]any{}}
+	m := NewMigrator(t.TempDir(), target, "test")
+	if err := m.Import(loaded, true); err != nil {
+		t.Fatalf("Unable to import: %s", err.Error())
+	}
+	m.PrepMigration()
+	if _, err := m.RunMigration(); err != nil {
+		t.Fatalf("Unable to run: %s", err.Error())
+	}
+	delete(source.docs, "other/z")
+	if !reflect.DeepEqual(target.docs, source.docs) {
+		t.Fatalf("Mismatched imported documents %v", target.docs)
+	}
+
+	again := NewMigrator(t.TempDir(), target, "again")
+	again.Import(loaded, true)
+	again.PrepMigration()
+	if again.changes[0].command != MigratorAdd || again.changes[0].errState == nil {
+		t.Fatalf("Import with create overwrote an existing document")
+	}
+	again = NewMigrator(t.TempDir(), target, "again")
+	again.Import(loaded, false)
+	again.PrepMigration()
+	if again.changes[0].command != MigratorSet || again.changes[0].errState != nil {
+		t.Fatalf("Import did not set existing documents")
+	}
+}
+
+// TestNamedDatabase verifies a client on a named database is named by its database and
+// serializes references into it relative to it.
+func TestNamedDatabase(t *testing.T) {
+	ctx := context.Background()
+	client, err := firestore.NewClientWithDatabase(ctx, "p", "archive", option.WithoutAuthentication(), option.WithEndpoint("localhost:1"))
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err.Error())
+	}
+	defer client.Close()
+	f := fireFriend{client: client, ctx: ctx}
+	if f.name() != "projects/p/databases/archive" {
+		t.Fatalf("Mismatched database name %s", f.name())
+	}
+	if refPath("projects/p/databases/archive/documents/users/a", f) != "users/a" {
+		t.Fatalf("Reference into the named database was not relative")
+	}
+	if refPath("projects/p/databases/(default)/documents/users/a", f) != "projects/p/databases/(default)/documents/users/a" {
+		t.Fatalf("Reference into the default database was not kept whole")
+	}
+	ref := f.refField("users/a").(*firestore.DocumentRef)
+	if ref.Path != "projects/p/databases/archive/documents/users/a" {
+		t.Fatalf("Mismatched reference %s", ref.Path)
+	}
+	if f.refField("projects/p/databases/(default)/documents/users/a").(*firestore.DocumentRef).Path != "projects/p/databases/(default)/documents/users/a" {
+		t.Fatalf("Cross database reference did not round trip")
+	}
+}
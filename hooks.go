@@ -0,0 +1,111 @@
+package fig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RunHook is called with the run report before or after a migration runs. Before the run the
+// report holds only the migration metadata.
+type RunHook func(report *RunReport) error
+
+// ChangeHook is called after each change is pushed with the change and its result.
+type ChangeHook func(c *Change, result ChangeResult)
+
+// ErrorHook is called with the run report when a run is aborted, a change fails or the
+// run cannot be recorded.
+type ErrorHook func(report *RunReport, err error)
+
+// hooks are the lifecycle hooks registered on a Migrator, called in registration order.
+type hooks struct {
+	beforeRun   []RunHook
+	afterChange []ChangeHook
+	afterRun    []RunHook
+	onError     []ErrorHook
+}
+
+// BeforeRun registers a hook called after the execution lock is acquired and before any change
+// is pushed. An error from the hook aborts the run.
+func (m *Migrator) BeforeRun(hook RunHook) {
+	m.hooks.beforeRun = append(m.hooks.beforeRun, hook)
+}
+
+// AfterChange registers a hook called after each change is pushed.
+func (m *Migrator) AfterChange(hook ChangeHook) {
+	m.hooks.afterChange = append(m.hooks.afterChange, hook)
+}
+
+// AfterRun registers a hook called with the finished report once the run is recorded.
+func (m *Migrator) AfterRun(hook RunHook) {
+	m.hooks.afterRun = append(m.hooks.afterRun, hook)
+}
+
+// OnError registers a hook called for every error during a run.
+func (m *Migrator) OnError(hook ErrorHook) {
+	m.hooks.onError = append(m.hooks.onError, hook)
+}
+
+// runBefore calls the BeforeRun hooks and stops at the first error.
+func (m *Migrator) runBefore(report *RunReport) error {
+	for _, hook := range m.hooks.beforeRun {
+		if err := hook(report); err != nil {
+			err = fmt.Errorf("BeforeRun hook aborted the migration: %w", err)
+			m.runOnError(report, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// runAfterChange calls the AfterChange hooks.
+func (m *Migrator) runAfterChange(c *Change, result ChangeResult) {
+	for _, hook := range m.hooks.afterChange {
+		hook(c, result)
+	}
+}
+
+// runAfter calls every AfterRun hook and returns the first error.
+func (m *Migrator) runAfter(report *RunReport) error {
+	var first error
+	for _, hook := range m.hooks.afterRun {
+		if err := hook(report); err != nil {
+			err = fmt.Errorf("AfterRun hook failed: %w", err)
+			m.runOnError(report, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// runOnError calls the OnError hooks.
+func (m *Migrator) runOnError(report *RunReport, err error) {
+	for _, hook := range m.hooks.onError {
+		hook(report, err)
+	}
+}
+
+// Webhook returns a RunHook which posts the run report as json to the url. Any response
+// status other than 2xx is returned as an error.
+func Webhook(url string) RunHook {
+	client := &http.Client{Timeout: 30 * time.Second}
+	return func(report *RunReport) error {
+		js, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		res, err := client.Post(url, "application/json", bytes.NewReader(js))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return fmt.Errorf("Webhook returned %s.", res.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package fig
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// idAlphabet is the set of characters used in generated document IDs.
+const idAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-"
+
+// idSize is the length of generated document IDs.
+const idSize = 20
+
+// SetIDSeed makes Add generate document IDs deterministically from the seed. The nth document
+// added to a collection always gets the same ID, so re-running a staging script reproduces
+// the same migration. An empty seed restores random IDs.
+func (m *Migrator) SetIDSeed(seed string) {
+	m.idSeed = seed
+	m.idCounts = map[string]int{}
+}
+
+// genDocPath returns the path of a new document in the collection.
+func (m *Migrator) genDocPath(colPath string) (string, error) {
+	if m.idSeed == "" {
+		return m.database.genDocPath(colPath)
+	}
+	if m.idCounts == nil {
+		m.idCounts = map[string]int{}
+	}
+	n := m.idCounts[colPath]
+	m.idCounts[colPath]++
+	return colPath + "/" + seededID(m.idSeed, colPath, n), nil
+}
+
+// seededID derives the nth document ID of a collection from the seed.
+func seededID(seed string, colPath string, n int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", seed, colPath, n)))
+	id := make([]byte, idSize)
+	for i := range id {
+		id[i] = idAlphabet[int(sum[i])%len(idAlphabet)]
+	}
+	return string(id)
+}
@@ -0,0 +1,193 @@
+package fig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	hmacSigPrefix    = "hmac-sha256:"
+	ed25519SigPrefix = "ed25519:"
+)
+
+// integrity holds the keys used to seal and verify stored migrations.
+type integrity struct {
+	hmacKey         []byte
+	signKey         ed25519.PrivateKey
+	verifyKey       ed25519.PublicKey
+	allowUnverified bool
+}
+
+// signed reports whether a signing or verification key is configured.
+func (i integrity) signed() bool {
+	return len(i.hmacKey) > 0 || len(i.signKey) > 0 || len(i.verifyKey) > 0
+}
+
+// publicKey returns the ed25519 key used to verify signatures, if any.
+func (i integrity) publicKey() ed25519.PublicKey {
+	if len(i.verifyKey) > 0 {
+		return i.verifyKey
+	}
+	if len(i.signKey) > 0 {
+		return i.signKey.Public().(ed25519.PublicKey)
+	}
+	return nil
+}
+
+// migrationDigest returns the sha256 content hash of a migration. The checksum and signature
+// fields are excluded and the content is hashed in a canonical form, so the hash survives a
+// round trip through any store.
+func migrationDigest(mig Migration) ([]byte, error) {
+	mig.Checksum = ""
+	mig.Signature = ""
+	js, err := json.Marshal(mig)
+	if err != nil {
+		return nil, err
+	}
+	var content any
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.UseNumber()
+	if err := decoder.Decode(&content); err != nil {
+		return nil, err
+	}
+	js, err = json.Marshal(canonicalValue(content))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(js)
+	return sum[:], nil
+}
+
+// legacyDigest returns the content hash used before hashing was canonical, so migrations
+// sealed by older versions still verify.
+func legacyDigest(mig Migration) ([]byte, error) {
+	mig.Checksum = ""
+	mig.Signature = ""
+	mig.Timestamp = mig.Timestamp.UTC().Truncate(time.Microsecond)
+	js, err := json.Marshal(mig)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(js)
+	return sum[:], nil
+}
+
+// canonicalValue normalizes decoded json the way storing it may change it. Numbers become
+// doubles, timestamps are in UTC to the microsecond Firestore stores, and empty arrays and
+// maps are null.
+func canonicalValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		if len(t) == 0 {
+			return nil
+		}
+		out := map[string]any{}
+		for k, item := range t {
+			out[k] = canonicalValue(item)
+		}
+		return out
+	case []any:
+		if len(t) == 0 {
+			return nil
+		}
+		out := make([]any, len(t))
+		for i, item := range t {
+			out[i] = canonicalValue(item)
+		}
+		return out
+	case json.Number:
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return ts.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+		}
+	}
+	return v
+}
+
+// seal embeds the content hash and, if a key is configured, a signature on the migration.
+func (i integrity) seal(mig *Migration) error {
+	digest, err := migrationDigest(*mig)
+	if err != nil {
+		return err
+	}
+	mig.Checksum = hex.EncodeToString(digest)
+	mig.Signature = ""
+	if len(i.signKey) > 0 {
+		sig := ed25519.Sign(i.signKey, digest)
+		mig.Signature = ed25519SigPrefix + base64.StdEncoding.EncodeToString(sig)
+	} else if len(i.hmacKey) > 0 {
+		mac := hmac.New(sha256.New, i.hmacKey)
+		mac.Write(digest)
+		mig.Signature = hmacSigPrefix + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return nil
+}
+
+// verify returns an error if the migration checksum or signature does not verify. Unsealed
+// migrations are accepted only when no key is configured, which keeps hand built files loadable.
+func (i integrity) verify(mig Migration) error {
+	err := i.check(mig)
+	if err != nil && i.allowUnverified {
+		return nil
+	}
+	return err
+}
+
+// check does the work for verify without regard to the override.
+func (i integrity) check(mig Migration) error {
+	if mig.Checksum == "" {
+		if i.signed() {
+			return errors.New("Migration has no checksum or signature.")
+		}
+		return nil
+	}
+	digest, err := migrationDigest(mig)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(digest) != mig.Checksum {
+		digest, err = legacyDigest(mig)
+		if err != nil || hex.EncodeToString(digest) != mig.Checksum {
+			return errors.New("Migration checksum does not match its contents. The file may have been modified.")
+		}
+	}
+	if !i.signed() {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(mig.Signature, ed25519SigPrefix):
+		pub := i.publicKey()
+		if pub == nil {
+			return errors.New("Migration is signed with ed25519 but no ed25519 key is configured.")
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(mig.Signature, ed25519SigPrefix))
+		if err != nil || !ed25519.Verify(pub, digest, sig) {
+			return errors.New("Migration signature does not verify.")
+		}
+	case strings.HasPrefix(mig.Signature, hmacSigPrefix):
+		if len(i.hmacKey) == 0 {
+			return errors.New("Migration is signed with hmac but no hmac key is configured.")
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(mig.Signature, hmacSigPrefix))
+		mac := hmac.New(sha256.New, i.hmacKey)
+		mac.Write(digest)
+		if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("Migration signature does not verify.")
+		}
+	default:
+		return errors.New("Migration is not signed.")
+	}
+	return nil
+}
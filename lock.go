@@ -0,0 +1,400 @@
+package fig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// defaultLockTTL is how long an execution lock is held without a heartbeat before it goes stale.
+const defaultLockTTL = 2 * time.Minute
+
+// lockName is the file/doc name of the execution lock within the storage path.
+const lockName = "_lock"
+
+// lease is the record stored for an execution lock.
+type lease struct {
+	Owner     string    `json:"owner"`
+	Operator  string    `json:"operator,omitempty"`
+	Migration string    `json:"migration"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Expires   time.Time `json:"expires"`
+}
+
+// data converts the lease to document data.
+func (l lease) data() map[string]any {
+	return map[string]any{
+		"owner":     l.Owner,
+		"operator":  l.Operator,
+		"migration": l.Migration,
+		"acquired":  l.Acquired,
+		"heartbeat": l.Heartbeat,
+		"expires":   l.Expires,
+	}
+}
+
+// leaseFromData converts document data to a lease.
+func leaseFromData(data map[string]any) lease {
+	l := lease{}
+	l.Owner, _ = data["owner"].(string)
+	l.Operator, _ = data["operator"].(string)
+	l.Migration, _ = data["migration"].(string)
+	l.Acquired, _ = data["acquired"].(time.Time)
+	l.Heartbeat, _ = data["heartbeat"].(time.Time)
+	l.Expires, _ = data["expires"].(time.Time)
+	return l
+}
+
+// lockedError describes the lease held by another run, naming its operator as the audit log
+// does.
+func (l lease) lockedError() error {
+	holder := l.Owner
+	if l.Operator != "" && l.Operator != l.Owner {
+		holder = fmt.Sprintf("%s (%s)", l.Operator, l.Owner)
+	}
+	return fmt.Errorf(
+		"Migration lock is held by %s running %s until %s. If the lock is stale, clear it with ForceUnlock.",
+		holder, l.Migration, l.Expires.Format(time.RFC3339),
+	)
+}
+
+// leaseStore persists execution locks. An empty owner on release forces the lock open.
+type leaseStore interface {
+	claimLease(l lease, now time.Time) error
+	renewLease(l lease) error
+	releaseLease(owner string) error
+}
+
+// dbLease stores the lock as a document on the database.
+type dbLease struct {
+	db      figFirestore
+	docPath string
+}
+
+// claimLease creates the lock document or takes over one that is stale or already ours.
+func (d dbLease) claimLease(l lease, now time.Time) error {
+	return d.db.transactDoc(d.docPath, func(data map[string]any, exists bool) (map[string]any, error) {
+		if exists {
+			held := leaseFromData(data)
+			if held.Owner != l.Owner && now.Before(held.Expires) {
+				return nil, held.lockedError()
+			}
+		}
+		return l.data(), nil
+	})
+}
+
+// renewLease updates the heartbeat and expiry of a lock we hold.
+func (d dbLease) renewLease(l lease) error {
+	return d.db.transactDoc(d.docPath, func(data map[string]any, exists bool) (map[string]any, error) {
+		if !exists || leaseFromData(data).Owner != l.Owner {
+			return nil, errors.New("Migration lock was lost.")
+		}
+		return l.data(), nil
+	})
+}
+
+// releaseLease deletes the lock document if we hold it.
+func (d dbLease) releaseLease(owner string) error {
+	return d.db.transactDoc(d.docPath, func(data map[string]any, exists bool) (map[string]any, error) {
+		if exists && owner != "" && leaseFromData(data).Owner != owner {
+			return data, nil
+		}
+		return nil, nil
+	})
+}
+
+// fileLease stores the lock as a json file in the local storage path.
+type fileLease struct {
+	path string
+}
+
+// read loads the lock file.
+func (f fileLease) read() (lease, error) {
+	var l lease
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(content, &l)
+	return l, err
+}
+
+// write atomically replaces the lock file with the lease.
+func (f fileLease) write(l lease) error {
+	tmp, err := f.temp(l)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// temp writes the lease to a file of its own next to the lock file and returns its path.
+func (f fileLease) temp(l lease) (string, error) {
+	js, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", f.path, os.Getpid())
+	return tmp, os.WriteFile(tmp, js, 0644)
+}
+
+// errLockBusy is returned while another run holds the guard of a lock file.
+var errLockBusy = errors.New("Migration lock is being changed by another run. Try again, or clear it with ForceUnlock.")
+
+// guardTTL is how long a guard may be held. A guard is held for one read and write of the lock
+// file, so an older one was left by a run which did not exit cleanly.
+const guardTTL = 30 * time.Second
+
+// guard serializes changes to an existing lock file between processes. It is held only while
+// one claim, renewal or release reads, checks and writes the lock file. A guard older than
+// guardTTL is broken.
+func (f fileLease) guard() (func(), error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		g, err := os.OpenFile(f.path+".guard", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			g.Close()
+			return func() { os.Remove(f.path + ".guard") }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if !f.breakGuard() {
+			return nil, errLockBusy
+		}
+	}
+	return nil, errLockBusy
+}
+
+// breakGuard removes a guard older than guardTTL and reports whether the guard is gone. The
+// guard is moved aside before it is checked again, so a guard another run took in the
+// meantime is put back rather than removed.
+func (f fileLease) breakGuard() bool {
+	path := f.path + ".guard"
+	info, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	if time.Since(info.ModTime()) < guardTTL {
+		return false
+	}
+	aside := fmt.Sprintf("%s.%d.stale", path, os.Getpid())
+	if err := os.Rename(path, aside); err != nil {
+		return os.IsNotExist(err)
+	}
+	defer os.Remove(aside)
+	if info, err := os.Stat(aside); err == nil && time.Since(info.ModTime()) < guardTTL {
+		os.Link(aside, path)
+		return false
+	}
+	return true
+}
+
+// claimLease creates the lock file or takes over one that is stale or already ours. A new lock
+// file is linked into place complete, so it is never read part written. A lock file is only
+// taken over once its contents have been read and found expired, under the guard.
+func (f fileLease) claimLease(l lease, now time.Time) error {
+	tmp, err := f.temp(l)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(tmp, f.path)
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		unguard, err := f.guard()
+		if err != nil {
+			return err
+		}
+		held, err := f.read()
+		if os.IsNotExist(err) {
+			// released since the link failed
+			unguard()
+			continue
+		}
+		if err != nil {
+			unguard()
+			return fmt.Errorf("Unable to read migration lock: %w", err)
+		}
+		if held.Owner != l.Owner && now.Before(held.Expires) {
+			unguard()
+			return held.lockedError()
+		}
+		err = f.write(l)
+		unguard()
+		return err
+	}
+	return errors.New("Unable to claim migration lock.")
+}
+
+// renewLease rewrites the lock file with a new heartbeat and expiry if we hold it. A renewal
+// is skipped while another run holds the guard, since the next heartbeat renews in time.
+func (f fileLease) renewLease(l lease) error {
+	unguard, err := f.guard()
+	if errors.Is(err, errLockBusy) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unguard()
+	held, err := f.read()
+	if err != nil || held.Owner != l.Owner {
+		return errors.New("Migration lock was lost.")
+	}
+	return f.write(l)
+}
+
+// releaseLease removes the lock file if we hold it. An empty owner removes it regardless,
+// along with a guard left behind by a run that did not exit cleanly.
+func (f fileLease) releaseLease(owner string) error {
+	if owner == "" {
+		os.Remove(f.path + ".guard")
+	} else {
+		unguard, err := f.guard()
+		if err != nil {
+			return err
+		}
+		defer unguard()
+		held, err := f.read()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || held.Owner != owner {
+			return nil
+		}
+	}
+	err := os.Remove(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// minLockTTL is the shortest execution lock TTL. The heartbeat renews the lock three times
+// per TTL.
+const minLockTTL = 10 * time.Millisecond
+
+// heldLock is an acquired execution lock kept alive by a heartbeat until released.
+type heldLock struct {
+	store leaseStore
+	lease lease
+	ttl   time.Duration
+	stop  chan struct{}
+	done  sync.WaitGroup
+	mu    sync.Mutex
+	err   error
+}
+
+// acquireLock claims the execution lock for this Migrator and starts its heartbeat.
+func (m *Migrator) acquireLock() (*heldLock, error) {
+	ttl := m.lockTTL
+	if ttl == 0 {
+		ttl = defaultLockTTL
+	}
+	if ttl < minLockTTL {
+		return nil, fmt.Errorf("Lock TTL %s is shorter than the minimum of %s.", ttl, minLockTTL)
+	}
+	now := time.Now()
+	l := lease{
+		Owner:     operatorIdentity(),
+		Operator:  m.operatorName(),
+		Migration: m.name,
+		Acquired:  now,
+		Heartbeat: now,
+		Expires:   now.Add(ttl),
+	}
+	migrationStore, err := m.migrationStore()
+	if err != nil {
+		return nil, err
+	}
+	store := storeLeases(migrationStore)
+	if err := store.claimLease(l, now); err != nil {
+		return nil, err
+	}
+	h := heldLock{
+		store: store,
+		lease: l,
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+	}
+	h.done.Add(1)
+	go h.heartbeat()
+	return &h, nil
+}
+
+// heartbeat renews the lease until the lock is released. It stops at the first renewal which
+// fails, and the run sees the error through lost.
+func (h *heldLock) heartbeat() {
+	defer h.done.Done()
+	ticker := time.NewTicker(h.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			h.lease.Heartbeat = now
+			h.lease.Expires = now.Add(h.ttl)
+			if err := h.store.renewLease(h.lease); err != nil {
+				h.mu.Lock()
+				h.err = err
+				h.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// lost returns the error which stopped the heartbeat, if the lock may no longer be held.
+func (h *heldLock) lost() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// release stops the heartbeat and releases the lock.
+func (h *heldLock) release() error {
+	close(h.stop)
+	h.done.Wait()
+	return h.store.releaseLease(h.lease.Owner)
+}
+
+// ForceUnlock clears the execution lock regardless of who holds it. Use this to recover
+// from a stale lock left behind by a run that did not exit cleanly.
+func (m *Migrator) ForceUnlock() error {
+	store, err := m.migrationStore()
+	if err != nil {
+		return err
+	}
+	return storeLeases(store).releaseLease("")
+}
+
+// SetLockTTL sets how long the execution lock survives without a heartbeat.
+func (m *Migrator) SetLockTTL(ttl time.Duration) {
+	m.lockTTL = ttl
+}
+
+// operatorIdentity returns a description of who is running this process.
+func operatorIdentity() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s:%d", name, host, os.Getpid())
+}
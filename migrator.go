@@ -1,8 +1,10 @@
 package fig
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,23 +16,30 @@ import (
 // You cannot have multiple work units pointing to the same document in
 // a migration.
 type WorkUnit struct {
-	DocPath string         `json:"docPath" firestore:"docpath,omitempty"`
-	Patch   map[string]any `json:"patch,omitempty" patch:"executed,omitempty"`
-	Command Command        `json:"command,omitempty" firestore:"command,omitempty"`
+	DocPath    string         `json:"docPath" firestore:"docpath,omitempty"`
+	Patch      map[string]any `json:"patch,omitempty" patch:"executed,omitempty"`
+	Command    Command        `json:"command,omitempty" firestore:"command,omitempty"`
+	Fields     []string       `json:"fields,omitempty" firestore:"fields,omitempty"`
+	Conditions []Condition    `json:"conditions,omitempty" firestore:"conditions,omitempty"`
 }
 
 // Migration represents all the instructions needed by the migrator to orchestrate a job.
 // All migration jobs including rollbacks take this form.
 type Migration struct {
-	DatabaseName string     `json:"databaseName" firestore:"databaseName,omitempty"`
-	Timestamp    time.Time  `json:"timestamp" firestore:"timestamp,omitempty"`
-	ChangeUnits  []WorkUnit `json:"changeUnits" firestore:"changeUnits,omitempty"`
-	Executed     bool       `json:"executed" firestore:"executed,omitempty"`
+	DatabaseName string        `json:"databaseName" firestore:"databaseName,omitempty"`
+	Environment  string        `json:"environment,omitempty" firestore:"environment,omitempty"`
+	Timestamp    time.Time     `json:"timestamp" firestore:"timestamp,omitempty"`
+	ChangeUnits  []WorkUnit    `json:"changeUnits" firestore:"changeUnits,omitempty"`
+	Executed     bool          `json:"executed" firestore:"executed,omitempty"`
+	Checksum     string        `json:"checksum,omitempty" firestore:"checksum,omitempty"`
+	Signature    string        `json:"signature,omitempty" firestore:"signature,omitempty"`
+	Verification *Verification `json:"verification,omitempty" firestore:"verification,omitempty"`
 }
 
 // Diff represents how we want to store our diffs
 type Diff struct {
-	Diff string `json:"diff" firestore:"diff,omitempty"`
+	Diff   string `json:"diff" firestore:"diff,omitempty"`
+	Format string `json:"format,omitempty" firestore:"format,omitempty"`
 }
 
 // <---------------------- Migrator ------------------------------------>
@@ -38,31 +47,93 @@ type Diff struct {
 // FigMigrator described what a GoFig Migrator implementeation should do.
 type FigMigrator interface {
 	SetDeleteFlag(flag string)
+	SetIntegrityKeys(hmacKey []byte, signKey ed25519.PrivateKey, verifyKey ed25519.PublicKey)
+	SetAllowUnverified(allow bool)
+	SetEnvironment(label string)
+	SetRetarget(allow bool)
+	SetLockTTL(ttl time.Duration)
+	ForceUnlock() error
+	SetOperator(operator string)
+	SetStore(store MigrationStore)
+	RegisterSchema(pattern string, schema Schema)
+	SetAllowInvalid(allow bool)
+	AddChangeRule(name string, rule ChangeRule)
+	AddMigrationRule(name string, rule MigrationRule)
+	Findings() []Finding
+	BeforeRun(hook RunHook)
+	AfterChange(hook ChangeHook)
+	AfterRun(hook RunHook)
+	OnError(hook ErrorHook)
+	SetVerify(verify bool)
+	SetBackup(backup bool)
+	SetIDSeed(seed string)
+	SetStagePolicy(policy StagePolicy)
+	Regenerate() error
+	Sync(source SyncSource, colPath string, recursive bool) error
+	ExportCollection(colPath string, recursive bool) (*Export, error)
+	Import(e *Export, create bool) error
+	RestoreBackup(name string) error
 	PrepMigration() error
 	PresentMigration()
-	RunMigration()
+	PresentSummary()
+	PageMigration(in io.Reader, out io.Writer)
+	ReviewMigration(in io.Reader, out io.Writer) ReviewResult
+	Browse(in io.Reader, out io.Writer) error
+	RenderMigration(format string) ([]byte, error)
+	SavePlan(formats ...string) error
+	SetRenderer(format string, renderer PlanRenderer)
+	RunMigration() (*RunReport, error)
 	LoadMigration() error
 	StoreMigration() error
 	deleteField() any
 	refField(docPath string) any
+	changeCount() int
 	Stage() FigStager
 }
 
 // Migrator is the API for performing migration tasks within a job it implements FigMigrator.
 type Migrator struct {
-	name        string
-	storagePath string
-	deleteFlag  string
-	database    figFirestore
-	changes     []*Change
-	hasRun      bool
+	name         string
+	storagePath  string
+	deleteFlag   string
+	database     figFirestore
+	changes      []*Change
+	hasRun       bool
+	integrity    integrity
+	environment  string
+	retarget     bool
+	rerun        bool
+	presented    string
+	target       migrationTarget
+	lockTTL      time.Duration
+	operator     string
+	store        MigrationStore
+	renderers    map[string]PlanRenderer
+	hooks        hooks
+	verify       bool
+	verification *Verification
+	backup       bool
+	idSeed       string
+	idCounts     map[string]int
+	stagePolicy  StagePolicy
+	replaced     map[string]bool
+	schemas      []schemaRule
+	allowInvalid bool
+	policies     []policy
+	findings     []Finding
+}
+
+// migrationTarget is the database and environment a loaded migration was recorded against.
+type migrationTarget struct {
+	database    string
+	environment string
 }
 
 // NewMigrator is a Migrator factory.
 func NewMigrator(storagePath string, database figFirestore, name string) *Migrator {
 	// /^[a-zA-Z0-9-_]+$/;
 	m := Migrator{
-		name:        regexp.MustCompile(`[^a-zA-Z0-9-_]+`).ReplaceAllString(name, ""),
+		name:        cleanName(name),
 		storagePath: storagePath,
 		deleteFlag:  "!delete",
 		database:    database,
@@ -70,11 +141,22 @@ func NewMigrator(storagePath string, database figFirestore, name string) *Migrat
 	return &m
 }
 
+// cleanName strips characters which are not valid in a migration name.
+func cleanName(name string) string {
+	return regexp.MustCompile(`[^a-zA-Z0-9-_]+`).ReplaceAllString(name, "")
+}
+
+// setName points the Migrator at another stored migration.
+func (m *Migrator) setName(name string) {
+	m.name = cleanName(name)
+}
+
 // buildRollback take the current Migrator state and prodces a Migration struct which
 // can later be loaded and run by the Migrator to rollback/inverse the initial state.
 func (m *Migrator) buildRollback() (*Migration, error) {
 	rollback := Migration{
 		DatabaseName: m.database.name(),
+		Environment:  m.environment,
 		Timestamp:    time.Now(),
 		Executed:     false,
 	}
@@ -82,18 +164,21 @@ func (m *Migrator) buildRollback() (*Migration, error) {
 		if c.errState != nil {
 			return nil, errors.New("Detected error state on changes.")
 		}
+		if c.skipped {
+			continue
+		}
 		var command Command
 		switch c.command {
 		case MigratorAdd:
 			command = MigratorDelete
 			break
-		case MigratorUpdate:
+		case MigratorUpdate, MigratorUpdateFields:
 			command = MigratorSet
 			break
 		case MigratorDelete:
 			command = MigratorAdd
 			break
-		case MigratorSet:
+		case MigratorSet, MigratorSetMerge:
 			if len(c.before) == 0 {
 				command = MigratorDelete
 			} else {
@@ -110,6 +195,7 @@ func (m *Migrator) buildRollback() (*Migration, error) {
 		}
 		rollback.ChangeUnits = append(rollback.ChangeUnits, u)
 	}
+	reverseComposed(rollback.ChangeUnits)
 	return &rollback, nil
 }
 
@@ -119,21 +205,10 @@ func (m *Migrator) storeRollback() error {
 	if err != nil {
 		return err
 	}
-	return m.Store(rollback, "_rollback")
-}
-
-// validateWorkset returns a new error if the staged Changes are not valid
-func (m *Migrator) validateWorkset() error {
-	// No duplicate docpath refs
-	docPaths := map[string]bool{}
-	for _, change := range m.changes {
-		_, ok := docPaths[change.docPath]
-		if ok {
-			return errors.New("Cannot have multiple changes staged against the same document reference.")
-		}
-		docPaths[change.docPath] = true
+	if err := m.integrity.seal(rollback); err != nil {
+		return err
 	}
-	return nil
+	return m.Store(rollback, "_rollback")
 }
 
 // SetDeleteFlag updates the Migrator delete flag with a new string value. When this value
@@ -142,6 +217,55 @@ func (m *Migrator) SetDeleteFlag(flag string) {
 	m.deleteFlag = flag
 }
 
+// SetIntegrityKeys configures the keys used to sign stored migrations and verify loaded ones.
+// An hmac key or an ed25519 key pair may be used. A verify key alone allows loading but not signing.
+func (m *Migrator) SetIntegrityKeys(hmacKey []byte, signKey ed25519.PrivateKey, verifyKey ed25519.PublicKey) {
+	m.integrity.hmacKey = hmacKey
+	m.integrity.signKey = signKey
+	m.integrity.verifyKey = verifyKey
+}
+
+// SetAllowUnverified lets LoadMigration accept migrations whose checksum or signature does not verify.
+func (m *Migrator) SetAllowUnverified(allow bool) {
+	m.integrity.allowUnverified = allow
+}
+
+// SetEnvironment labels the connected database, for example prod or staging. The label is
+// recorded on stored migrations and must match the label on loaded ones. A loaded migration
+// with a label is refused when no label is set.
+func (m *Migrator) SetEnvironment(label string) {
+	m.environment = label
+}
+
+// SetRetarget lets a migration recorded against another database or environment be loaded and run.
+func (m *Migrator) SetRetarget(allow bool) {
+	m.retarget = allow
+}
+
+// SetRerun lets a migration which has already run be run again, applying its changes a
+// second time.
+func (m *Migrator) SetRerun(allow bool) {
+	m.rerun = allow
+}
+
+// checkTarget returns an error if the loaded migration was recorded against a different
+// database or environment than the one connected, unless retargeting is allowed.
+func (m *Migrator) checkTarget() error {
+	if m.retarget {
+		return nil
+	}
+	if m.target.database != "" && m.target.database != m.database.name() {
+		return fmt.Errorf("Migration targets database %s but connected to %s.", m.target.database, m.database.name())
+	}
+	if m.target.environment != "" && m.environment == "" {
+		return fmt.Errorf("Migration targets environment %s but no environment is set.", m.target.environment)
+	}
+	if m.target.environment != "" && m.target.environment != m.environment {
+		return fmt.Errorf("Migration targets environment %s but connected to %s.", m.target.environment, m.environment)
+	}
+	return nil
+}
+
 type transformMode int
 
 const (
@@ -153,65 +277,184 @@ const (
 // PrepMigration is run after all changes are staged. This function validates and solves all of the changes.
 // No changes are pushed to the database.
 func (m *Migrator) PrepMigration() error {
-	err := m.validateWorkset()
-	if err != nil {
-		return err
-	}
-	for _, c := range m.changes {
-		c.SolveChange()
-	}
+	m.solveChanges()
+	m.validateSchemas()
+	m.applyPolicies()
 	return nil
 }
 
-// PresentMigration prints all the staged changes to stdout for review.
+// PresentMigration prints a summary of the staged changes followed by an abbreviated diff of
+// each change to stdout for review. Use PageMigration to expand a single change in full and
+// RenderMigration or SavePlan for other formats.
 func (m *Migrator) PresentMigration() {
-	diffText := ""
+	diffText := m.renderHeader()
+	diffText += m.renderSummary()
+	for _, c := range m.changes {
+		diffText += m.renderChange(c, false)
+	}
+	diffText += separator(m.headerLength())
+	fmt.Print(diffText)
+}
+
+// PresentSummary prints the migration header and a summary of the staged changes to stdout.
+func (m *Migrator) PresentSummary() {
+	fmt.Print(m.renderHeader() + m.renderSummary() + separator(m.headerLength()))
+}
+
+// headerLength returns the separator length used around the migration header.
+func (m *Migrator) headerLength() int {
 	lngth := maxNum(len(m.name), len(m.database.name()))
-	lngth = maxNum(lngth, len(m.storagePath)) + 26
-	diffText += m.printSeparator(lngth)
+	return maxNum(lngth, len(m.storagePath)) + 26
+}
 
-	h := fmt.Sprintf(
-		"Migration Name:	%s\nDatabase:	%s\nStorage Path:	%s\nHas Run:	%v\n",
+// renderHeader returns the migration header.
+func (m *Migrator) renderHeader() string {
+	h := separator(m.headerLength())
+	h += m.presentEnvironment()
+	hash := m.presentHash()
+	h += fmt.Sprintf(
+		"Migration Name:	%s\nDatabase:	%s\nStorage Path:	%s\nHas Run:	%v\nPlan Hash:	%s\n",
 		"  "+m.name,
 		"  "+m.database.name(),
 		"  "+m.storagePath,
 		"  "+strconv.FormatBool(m.hasRun),
+		"  "+hash,
 	)
-	fmt.Print(h)
-	diffText += h
+	return h
+}
+
+// renderSummary returns the counts of staged changes by command and by collection.
+func (m *Migrator) renderSummary() string {
+	byCommand := map[string]int{}
+	byCollection := map[string]int{}
+	errCount := 0
+	invalidCount := 0
 	for _, c := range m.changes {
-		lngth = len(c.docPath) + len(c.commandString()) + 19
-		header, cOut := c.Present()
-		lineLength, _ := longestLine(cOut)
-		maxLength := maxNum(lngth, lineLength-12)
-		diffText += m.printSeparator(maxLength)
-		headerPad := strings.Repeat(" ", maxLength-utf8.RuneCountInString(header[0]+header[1])+14)
-		b := strings.Join(header, headerPad) + cOut
-		fmt.Print(b)
-		diffText += b
-	}
-	diffText += m.printSeparator(lngth)
-
-	// os.WriteFile(fmt.Sprintf("%s_diff.txt", m.name), []byte(diffText), 0644)
-	// m.Store(
-	// 	Diff{
-	// 		Diff: diffText,
-	// 	},
-	// 	"diff",
-	// )
-}
-
-// printSeparator prints a horizontal separator to stdout
-func (m *Migrator) printSeparator(length int) string {
+		byCommand[c.commandString()]++
+		byCollection[c.collectionPath()]++
+		if c.errState != nil {
+			errCount++
+		}
+		if len(c.violations) > 0 {
+			invalidCount++
+		}
+	}
+
+	out := fmt.Sprintf("Changes:	  %d\n", len(m.changes))
+	if errCount > 0 {
+		out += clrTheme().red(fmt.Sprintf("Errors:		  %d", errCount)) + "\n"
+	}
+	if invalidCount > 0 {
+		out += clrTheme().red(fmt.Sprintf("Invalid:	  %d", invalidCount)) + "\n"
+	}
+	out += "\nBy command:\n" + renderCounts(byCommand)
+	out += "\nBy collection:\n" + renderCounts(byCollection)
+	out += m.renderFindings()
+	return out
+}
+
+// renderChange returns the presentation of one change with a full or abbreviated diff.
+func (m *Migrator) renderChange(c *Change, full bool) string {
+	lngth := len(c.docPath) + len(c.commandString()) + 19
+	header, cOut := c.PresentAbbreviated()
+	if full {
+		header, cOut = c.Present()
+	}
+	lineLength, _ := longestLine(cOut)
+	maxLength := maxNum(lngth, lineLength-12)
+	headerPad := strings.Repeat(" ", maxLength-utf8.RuneCountInString(header[0]+header[1])+14)
+	return separator(maxLength) + strings.Join(header, headerPad) + cOut
+}
+
+// presentEnvironment returns a banner naming the environment and any retarget in effect.
+func (m *Migrator) presentEnvironment() string {
+	out := ""
+	if m.environment != "" {
+		label := fmt.Sprintf(">>> ENVIRONMENT: %s <<<", strings.ToUpper(m.environment))
+		if strings.HasPrefix(strings.ToLower(m.environment), "prod") {
+			out += clrTheme().red(label) + "\n\n"
+		} else {
+			out += clrTheme().yellow(label) + "\n\n"
+		}
+	}
+	if m.target.database != "" && m.target.database != m.database.name() {
+		out += clrTheme().red(fmt.Sprintf("!!! RETARGETED FROM DATABASE %s !!!", m.target.database)) + "\n\n"
+	}
+	if m.target.environment != "" && m.environment != "" && m.target.environment != m.environment {
+		out += clrTheme().red(fmt.Sprintf("!!! RETARGETED FROM ENVIRONMENT %s !!!", strings.ToUpper(m.target.environment))) + "\n\n"
+	}
+	return out
+}
+
+// separator returns a horizontal separator
+func separator(length int) string {
 	dashes := strings.Repeat("-", length)
-	sep := fmt.Sprintf("\n<%s>\n<%s>\n\n", dashes, dashes)
-	fmt.Printf(sep)
-	return sep
+	return fmt.Sprintf("\n<%s>\n<%s>\n\n", dashes, dashes)
 }
 
-// RunMigration executes all of the staged changes against the database.
-func (m *Migrator) RunMigration() {
-	for _, c := range m.changes {
+// RunMigration executes all of the staged changes against the database. The returned report
+// holds the outcome of each change and is appended to the audit log.
+func (m *Migrator) RunMigration() (*RunReport, error) {
+	if m.hasRun && !m.rerun {
+		return nil, errors.New("Migration has already run. Allow a re-run to apply its changes again.")
+	}
+	if err := m.checkTarget(); err != nil {
+		return nil, err
+	}
+	// schemas and rules run again, since a change may have been edited after the migration was
+	// prepared
+	m.validateSchemas()
+	if err := m.checkSchemas(); err != nil {
+		return nil, err
+	}
+	m.applyPolicies()
+	if err := m.checkPolicies(); err != nil {
+		return nil, err
+	}
+	hash, err := m.planHash()
+	if err != nil {
+		return nil, err
+	}
+	if m.presented != "" && m.presented != hash {
+		return nil, fmt.Errorf("Plan %s is not the plan %s that was presented. Present the migration again before running it.", hash, m.presented)
+	}
+	lock, err := m.acquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	report := RunReport{
+		Migration:    m.name,
+		DatabaseName: m.database.name(),
+		Environment:  m.environment,
+		Operator:     m.operatorName(),
+		PlanHash:     hash,
+		Started:      time.Now(),
+	}
+	if err := m.runBefore(&report); err != nil {
+		return nil, err
+	}
+	if m.backup {
+		name, err := m.takeBackup()
+		if err != nil {
+			err = fmt.Errorf("Unable to back up documents: %w", err)
+			m.runOnError(&report, err)
+			return nil, err
+		}
+		report.Backup = name
+	}
+	var lockErr error
+	for i, c := range m.changes {
+		if err := lock.lost(); err != nil {
+			// the remaining changes were never written, so they are left out of the rollback
+			lockErr = fmt.Errorf("Run aborted after %d of %d changes: %w", i, len(m.changes), err)
+			m.runOnError(&report, lockErr)
+			for _, unrun := range m.changes[i:] {
+				unrun.skipped = true
+			}
+			break
+		}
 		err := c.pushChange(
 			func(data map[string]any) map[string]any {
 				return data
@@ -219,15 +462,55 @@ func (m *Migrator) RunMigration() {
 				// return m.toggleDeleteFlag(data, DeSerialize)
 			},
 		)
-		if err != nil {
+		result := ChangeResult{
+			DocPath: c.docPath,
+			Command: c.command,
+			Status:  ChangeApplied,
+		}
+		c.skipped = errors.Is(err, errConditionFailed)
+		if c.skipped {
+			result.Status = ChangeSkipped
+			result.Error = err.Error()
+		} else if err != nil {
 			fmt.Println("\n< !!! EXECUTION ERROR !!! >")
 			fmt.Println(c.docPath)
 			fmt.Println(err.Error() + "\n")
+			result.Status = ChangeFailed
+			result.Error = err.Error()
+			m.runOnError(&report, fmt.Errorf("%s: %w", c.docPath, err))
+		}
+		report.Results = append(report.Results, result)
+		m.runAfterChange(c, result)
+	}
+	if m.verify {
+		report.Verification = m.verifyChanges(&report)
+		m.verification = report.Verification
+		if !report.Verification.Passed() {
+			m.runOnError(&report, fmt.Errorf("%d documents do not match their after values.", len(report.Verification.Mismatches)))
 		}
 	}
+	report.Finished = time.Now()
 	m.hasRun = true
-	m.StoreMigration()
-	m.storeRollback()
+
+	auditErr := m.appendAudit(&report)
+	if auditErr != nil {
+		m.runOnError(&report, auditErr)
+	}
+	if err := m.StoreMigration(); err != nil {
+		m.runOnError(&report, err)
+		return &report, err
+	}
+	if err := m.storeRollback(); err != nil {
+		m.runOnError(&report, err)
+		return &report, err
+	}
+	if lockErr != nil {
+		return &report, lockErr
+	}
+	if err := m.runAfter(&report); err != nil && auditErr == nil {
+		return &report, err
+	}
+	return &report, auditErr
 }
 
 // LoadMigration will look for an existing migration file matching this Migrator's name.
@@ -235,29 +518,59 @@ func (m *Migrator) RunMigration() {
 // This is the preferred workflow for loading a rollback.
 func (m *Migrator) LoadMigration() error {
 	var mig Migration
-	err := loadFig(m.database, m.storagePath+"/"+m.name, &mig)
+	store, err := m.migrationStore()
 	if err != nil {
 		return err
 	}
+	if err := store.Load(m.name, &mig); err != nil {
+		return err
+	}
+	if err := m.integrity.verify(mig); err != nil {
+		return err
+	}
+	m.target = migrationTarget{
+		database:    mig.DatabaseName,
+		environment: mig.Environment,
+	}
+	if err := m.checkTarget(); err != nil {
+		return err
+	}
 	m.hasRun = mig.Executed
+	m.presented = ""
+	m.replaced = nil
+	m.verification = mig.Verification
 	m.changes = []*Change{}
+	// every stored change is kept, so changes composed on one document load as composed
+	policy := m.stagePolicy
+	m.stagePolicy = StageCompose
+	defer func() { m.stagePolicy = policy }()
 	for _, unit := range mig.ChangeUnits {
 		patch := deSerializeData(unit.Patch, m.database).(map[string]any)
+		stager := Stager{migrator: m, conditions: deSerializeConditions(unit.Conditions, m.database)}
 		switch unit.Command {
 		case MigratorAdd:
-			err = m.Stage().Set(unit.DocPath, patch)
+			err = stager.addDoc(unit.DocPath, patch)
 			break
 		case MigratorSet:
-			err = m.Stage().Set(unit.DocPath, patch)
+			err = stager.Set(unit.DocPath, patch)
 			break
 		case MigratorUpdate:
-			err = m.Stage().Update(unit.DocPath, patch)
+			err = stager.Update(unit.DocPath, patch)
 			break
 		case MigratorDelete:
-			err = m.Stage().Delete(unit.DocPath)
+			err = stager.Delete(unit.DocPath)
+			break
+		case MigratorSetMerge:
+			err = stager.SetMerge(unit.DocPath, patch, unit.Fields...)
+			break
+		case MigratorUpdateFields:
+			var updates []FieldUpdate
+			if updates, err = patchFieldUpdates(patch); err == nil {
+				err = stager.UpdateFields(unit.DocPath, updates)
+			}
 			break
 		default:
-			err = m.Stage().Unknown(unit.DocPath, patch)
+			err = stager.Unknown(unit.DocPath, patch)
 		}
 		if err != nil {
 			return err
@@ -268,35 +581,68 @@ func (m *Migrator) LoadMigration() error {
 
 // StoreMigration converts the Migrator state to a Migration file and stores it to disc.
 func (m *Migrator) StoreMigration() error {
+	migration, err := m.buildMigration()
+	if err != nil {
+		return err
+	}
+	if err := m.integrity.seal(migration); err != nil {
+		return err
+	}
 
+	return m.Store(migration, "")
+
+}
+
+// buildMigration converts the current Migrator state to a Migration struct.
+func (m *Migrator) buildMigration() (*Migration, error) {
 	migration := Migration{
 		DatabaseName: m.database.name(),
+		Environment:  m.environment,
 		Timestamp:    time.Now(),
 		Executed:     m.hasRun,
+		Verification: m.verification,
 	}
-	
+
 	for _, c := range m.changes {
 		if c.errState != nil {
-			return errors.New("Detected error state on changes.")
+			return nil, errors.New("Detected error state on changes.")
 		}
 		u := WorkUnit{
-			DocPath: c.docPath,
-			Patch:   serializeData(c.patch, m.database).(map[string]any),
-			Command: c.command,
+			DocPath:    c.docPath,
+			Patch:      serializeData(c.patch, m.database).(map[string]any),
+			Command:    c.command,
+			Fields:     fieldPathStrings(c.fields),
+			Conditions: serializeConditions(c.conditions, m.database),
 		}
 		migration.ChangeUnits = append(migration.ChangeUnits, u)
 	}
+	return &migration, nil
+}
 
-	return m.Store(migration, "")
+// Store saves the target to the migration store under this Migrator's name plus the tag.
+func (m *Migrator) Store(target any, tag string) error {
+	store, err := m.migrationStore()
+	if err != nil {
+		return err
+	}
+	return store.Save(m.name+tag, target)
+}
 
+// SetStore replaces the migration store selected by the storage path.
+func (m *Migrator) SetStore(store MigrationStore) {
+	m.store = store
 }
 
-func (m *Migrator) Store(target any, tag string) error {
-	if strings.HasPrefix(m.storagePath, "[firestore]/") {
-		suffix := strings.Replace(m.storagePath, "[firestore]/", "", 1)
-		return m.database.setDocStruct(target, fmt.Sprintf("%s/%s", suffix, m.name+tag))
+// migrationStore returns the migration store, opening it from the storage path on first use.
+func (m *Migrator) migrationStore() (MigrationStore, error) {
+	if m.store == nil {
+		store, err := openStore(m.storagePath, m.database)
+		if err != nil {
+			return nil, err
+		}
+		m.store = store
 	}
-	return storeJson(target, m.storagePath, m.name+tag)
+	return m.store, nil
 }
 
 // deleteField returns the firestore Delete value which can be set on a nested
@@ -319,12 +665,27 @@ type FigStager interface {
 	Add(colPath string, data map[string]any) error
 	Delete(docPath string) error
 	Unknown(docPath string, data map[string]any) error
+	SetStruct(docPath string, model any) error
+	UpdateStruct(docPath string, model any) error
+	AddStruct(colPath string, model any) error
+	UpdateFields(docPath string, updates []FieldUpdate) error
+	SetMerge(docPath string, data map[string]any, fields ...string) error
+	When(conditions ...Condition) FigStager
+	AddWithID(colPath string, id string, data map[string]any) error
 }
 
 // Stager is an abstraction on top of Migrator which is used as an API
 // to stage new Change units on the Migrator.
 type Stager struct {
-	migrator *Migrator
+	migrator   *Migrator
+	conditions []Condition
+}
+
+// stage adds a change to the Migrator with the stager's conditions, following the stage
+// policy if the document already has a staged change.
+func (s Stager) stage(change *Change) error {
+	change.conditions = s.conditions
+	return s.migrator.restage(change)
 }
 
 // Update stages a new Update change on the Migrator.
@@ -334,8 +695,7 @@ func (s Stager) Update(docPath string, data map[string]any) error {
 		return err
 	}
 	change := NewChange(docPath, before, data, MigratorUpdate, s.migrator.database)
-	s.migrator.changes = append(s.migrator.changes, change)
-	return nil
+	return s.stage(change)
 }
 
 // Set stages a new Set change on the Migrator.
@@ -345,19 +705,40 @@ func (s Stager) Set(docPath string, data map[string]any) error {
 		return err
 	}
 	change := NewChange(docPath, before, data, MigratorSet, s.migrator.database)
-	s.migrator.changes = append(s.migrator.changes, change)
-	return nil
+	return s.stage(change)
 }
 
-// Add stages a new Add change on the Migrator.
+// Add stages a new Add change on the Migrator. The document ID is random unless an ID seed
+// is set on the Migrator. The change fails if the document already exists.
 func (s Stager) Add(colPath string, data map[string]any) error {
-	path, err := s.migrator.database.genDocPath(colPath)
+	path, err := s.migrator.genDocPath(colPath)
 	if err != nil {
 		return err
 	}
-	change := NewChange(path, map[string]any{}, data, MigratorAdd, s.migrator.database)
-	s.migrator.changes = append(s.migrator.changes, change)
-	return nil
+	return s.addDoc(path, data)
+}
+
+// AddWithID stages a new Add change creating the document with the given ID.
+func (s Stager) AddWithID(colPath string, id string, data map[string]any) error {
+	if id == "" || strings.Contains(id, "/") {
+		return errors.New("Document ID must be non empty and may not contain /.")
+	}
+	return s.addDoc(strings.Trim(colPath, "/")+"/"+id, data)
+}
+
+// addDoc stages an Add change for the document path. The live document is read so a collision
+// shows as an error before the run, except for migrations which have already run.
+func (s Stager) addDoc(docPath string, data map[string]any) error {
+	before := map[string]any{}
+	if !s.migrator.hasRun {
+		live, err := s.migrator.database.getDocData(docPath)
+		if err != nil {
+			return err
+		}
+		before = live
+	}
+	change := NewChange(docPath, before, data, MigratorAdd, s.migrator.database)
+	return s.stage(change)
 }
 
 // Delete stages a new Delete change on the Migrator.
@@ -367,8 +748,7 @@ func (s Stager) Delete(docPath string) error {
 		return err
 	}
 	change := NewChange(docPath, before, map[string]any{}, MigratorDelete, s.migrator.database)
-	s.migrator.changes = append(s.migrator.changes, change)
-	return nil
+	return s.stage(change)
 }
 
 // Unknown stages a new change on the Migrator of an Unknown command type.
@@ -378,8 +758,7 @@ func (s Stager) Unknown(docPath string, data map[string]any) error {
 		return err
 	}
 	change := NewChange(docPath, before, data, MigratorUnknown, s.migrator.database)
-	s.migrator.changes = append(s.migrator.changes, change)
-	return nil
+	return s.stage(change)
 }
 
 // Stage is a Stager factory
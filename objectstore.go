@@ -0,0 +1,371 @@
+package fig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+// ObjectStore keeps each record as a json object in an S3 compatible bucket. Requests use
+// path style addressing so local stand-ins such as MinIO work without DNS setup.
+type ObjectStore struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// errObjectNotFound is returned when a requested object does not exist.
+var errObjectNotFound = errors.New("Object not found.")
+
+// errPrecondition is returned when a conditional write is rejected.
+var errPrecondition = errors.New("Object precondition failed.")
+
+// objectStoreFromURL builds an ObjectStore from s3://bucket/prefix?endpoint=...&region=...
+// Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func objectStoreFromURL(storagePath string) (*ObjectStore, error) {
+	u, err := url.Parse(storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("Object storage path must name a bucket.")
+	}
+	s := ObjectStore{
+		Endpoint:  u.Query().Get("endpoint"),
+		Region:    u.Query().Get("region"),
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	return &s, nil
+}
+
+// region returns the configured region or the S3 default.
+func (s *ObjectStore) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// endpoint returns the configured endpoint or the AWS endpoint for the region.
+func (s *ObjectStore) endpoint() string {
+	if s.Endpoint == "" {
+		return "https://s3." + s.region() + ".amazonaws.com"
+	}
+	return strings.TrimRight(s.Endpoint, "/")
+}
+
+// key returns the object key for a record name.
+func (s *ObjectStore) key(name string) string {
+	if s.Prefix == "" {
+		return name + ".json"
+	}
+	return s.Prefix + "/" + name + ".json"
+}
+
+// List returns the names of the json objects under the prefix.
+func (s *ObjectStore) List() ([]string, error) {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+	names := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, _, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "_") {
+				continue
+			}
+			names = append(names, strings.TrimSuffix(name, ".json"))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Load reads the named object into target.
+func (s *ObjectStore) Load(name string, target any) error {
+	body, _, err := s.do(http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, target)
+}
+
+// Save writes target to the named object.
+func (s *ObjectStore) Save(name string, target any) error {
+	js, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.do(http.MethodPut, s.key(name), nil, js, nil)
+	return err
+}
+
+// Delete removes the named object.
+func (s *ObjectStore) Delete(name string) error {
+	_, _, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil)
+	return err
+}
+
+// saveReport writes raw report content next to the migrations.
+func (s *ObjectStore) saveReport(name string, content []byte) error {
+	key := name
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + name
+	}
+	_, _, err := s.do(http.MethodPut, key, nil, content, nil)
+	return err
+}
+
+func (s *ObjectStore) leases() leaseStore {
+	return objectLease{store: s}
+}
+
+// appendAudit writes the report to a new uniquely named object under the audit prefix.
+func (s *ObjectStore) appendAudit(report *RunReport) error {
+	id, err := nanoid.Generate("abcdefghijklmnopqrstuvwxyz0123456789", 8)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s/%s_%s", auditName, report.Started.UTC().Format("20060102T150405Z"), id)
+	_, _, err = s.do(http.MethodPut, s.key(name), nil, js, map[string]string{"If-None-Match": "*"})
+	return err
+}
+
+// do sends a signed request for the object key and returns the response body and etag.
+func (s *ObjectStore) do(method string, key string, query url.Values, body []byte, headers map[string]string) ([]byte, string, error) {
+	path := "/" + s.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	rawQuery := canonicalQuery(query)
+	target := s.endpoint() + escapePath(path)
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, escapePath(path), rawQuery, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, "", errObjectNotFound
+	case res.StatusCode == http.StatusPreconditionFailed || res.StatusCode == http.StatusConflict:
+		return nil, "", errPrecondition
+	case res.StatusCode >= 300:
+		return nil, "", fmt.Errorf("Object storage returned %s: %s", res.Status, strings.TrimSpace(string(content)))
+	}
+	return content, res.Header.Get("ETag"), nil
+}
+
+// sign adds AWS signature version 4 headers to the request.
+func (s *ObjectStore) sign(req *http.Request, path string, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		canonicalHeaders,
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region() + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, strings.Join(signed, ";"), signature,
+	))
+}
+
+// objectLease keeps the lock as an object claimed with conditional writes.
+type objectLease struct {
+	store *ObjectStore
+}
+
+// read returns the held lease and its etag.
+func (o objectLease) read() (lease, string, error) {
+	var l lease
+	body, etag, err := o.store.do(http.MethodGet, o.store.key(lockName), nil, nil, nil)
+	if err != nil {
+		return l, "", err
+	}
+	err = json.Unmarshal(body, &l)
+	return l, etag, err
+}
+
+// put writes the lease only if the object still matches the given condition.
+func (o objectLease) put(l lease, condition map[string]string) error {
+	js, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, _, err = o.store.do(http.MethodPut, o.store.key(lockName), nil, js, condition)
+	return err
+}
+
+func (o objectLease) claimLease(l lease, now time.Time) error {
+	held, etag, err := o.read()
+	if errors.Is(err, errObjectNotFound) {
+		err = o.put(l, map[string]string{"If-None-Match": "*"})
+	} else if err == nil {
+		if held.Owner != l.Owner && now.Before(held.Expires) {
+			return held.lockedError()
+		}
+		err = o.put(l, map[string]string{"If-Match": etag})
+	}
+	if errors.Is(err, errPrecondition) {
+		return errors.New("Migration lock was claimed by another run.")
+	}
+	return err
+}
+
+func (o objectLease) renewLease(l lease) error {
+	held, etag, err := o.read()
+	if err != nil || held.Owner != l.Owner {
+		return errors.New("Migration lock was lost.")
+	}
+	return o.put(l, map[string]string{"If-Match": etag})
+}
+
+func (o objectLease) releaseLease(owner string) error {
+	held, _, err := o.read()
+	if errors.Is(err, errObjectNotFound) {
+		return nil
+	}
+	if err == nil && owner != "" && held.Owner != owner {
+		return nil
+	}
+	_, _, err = o.store.do(http.MethodDelete, o.store.key(lockName), nil, nil, nil)
+	return err
+}
+
+// canonicalQuery encodes query parameters sorted by key as required for signing.
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapePath uri encodes each segment of an object path.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = uriEncode(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// uriEncode percent encodes everything but unreserved characters.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,99 @@
+package fig
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// pagerHelp lists the pager commands.
+const pagerHelp = "n: next  p: previous  g <path>: jump to path  e: expand  s: summary  q: done"
+
+// renderCounts returns a sorted two column listing of counts.
+func renderCounts(counts map[string]int) string {
+	keys := []string{}
+	width := 0
+	for k := range counts {
+		keys = append(keys, k)
+		width = maxNum(width, len(k))
+	}
+	sort.Strings(keys)
+	out := ""
+	for _, k := range keys {
+		out += fmt.Sprintf("  %-*s  %d\n", width, k, counts[k])
+	}
+	return out
+}
+
+// changeCount returns the number of staged changes.
+func (m *Migrator) changeCount() int {
+	return len(m.changes)
+}
+
+// PageMigration lets a reviewer step through the staged changes one at a time. Diffs are
+// abbreviated until expanded. Commands are read from in and pages are written to out.
+func (m *Migrator) PageMigration(in io.Reader, out io.Writer) {
+	if len(m.changes) == 0 {
+		fmt.Fprintln(out, "< no changes >")
+		return
+	}
+	i := 0
+	full := false
+	for {
+		c := m.changes[i]
+		fmt.Fprint(out, m.renderChange(c, full))
+		fmt.Fprintf(out, "\n[ change %d/%d ]  %s\n", i+1, len(m.changes), pagerHelp)
+
+		line, err := readLine(in)
+		if err != nil && line == "" {
+			return
+		}
+		full = false
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch cmd {
+		case "", "n":
+			if i < len(m.changes)-1 {
+				i++
+			} else {
+				fmt.Fprintln(out, "< end of changes >")
+			}
+		case "p":
+			if i > 0 {
+				i--
+			}
+		case "e":
+			full = true
+		case "s":
+			fmt.Fprint(out, m.renderSummary())
+		case "g":
+			j := m.findChange(strings.TrimSpace(arg), i)
+			if j < 0 {
+				fmt.Fprintf(out, "< no change matches %s >\n", arg)
+			} else {
+				i = j
+			}
+		case "q":
+			return
+		default:
+			fmt.Fprintf(out, "< unknown command %s >\n", cmd)
+		}
+	}
+}
+
+// findChange returns the index of the next change after from whose docPath matches or starts
+// with path, wrapping around to the beginning. It returns -1 if no change matches.
+func (m *Migrator) findChange(path string, from int) int {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return -1
+	}
+	for k := 1; k <= len(m.changes); k++ {
+		j := (from + k) % len(m.changes)
+		docPath := m.changes[j].docPath
+		if docPath == path || strings.HasPrefix(docPath, path+"/") {
+			return j
+		}
+	}
+	return -1
+}
@@ -0,0 +1,170 @@
+package fig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how strongly a Finding objects to a migration.
+type Severity string
+
+const (
+	// SeverityWarning is shown for review but does not stop the migration.
+	SeverityWarning Severity = "warning"
+	// SeverityError blocks the migration from running.
+	SeverityError Severity = "error"
+)
+
+// Finding is a warning or blocking error raised by a policy rule. DocPath is empty for
+// findings about the migration as a whole.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Rule     string   `json:"rule"`
+	DocPath  string   `json:"docPath,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// ChangeRule inspects one solved change and returns any findings.
+type ChangeRule func(c *Change) []Finding
+
+// MigrationRule inspects all staged changes together and returns any findings.
+type MigrationRule func(changes []*Change) []Finding
+
+// policy is a named rule registered on a Migrator.
+type policy struct {
+	name      string
+	change    ChangeRule
+	migration MigrationRule
+}
+
+// Warn returns a warning finding.
+func Warn(format string, a ...any) Finding {
+	return Finding{Severity: SeverityWarning, Message: fmt.Sprintf(format, a...)}
+}
+
+// Block returns a blocking finding.
+func Block(format string, a ...any) Finding {
+	return Finding{Severity: SeverityError, Message: fmt.Sprintf(format, a...)}
+}
+
+// AddChangeRule registers a rule run against each change by PrepMigration.
+func (m *Migrator) AddChangeRule(name string, rule ChangeRule) {
+	m.policies = append(m.policies, policy{name: name, change: rule})
+}
+
+// AddMigrationRule registers a rule run against the whole migration by PrepMigration.
+func (m *Migrator) AddMigrationRule(name string, rule MigrationRule) {
+	m.policies = append(m.policies, policy{name: name, migration: rule})
+}
+
+// Findings returns the findings of the policy rules from the last PrepMigration.
+func (m *Migrator) Findings() []Finding {
+	return m.findings
+}
+
+// applyPolicies runs every registered rule and records the findings. Changes left in an
+// error state are not passed to change rules.
+func (m *Migrator) applyPolicies() {
+	m.findings = m.replacedFindings()
+	for _, p := range m.policies {
+		if p.migration != nil {
+			for _, f := range p.migration(m.changes) {
+				f.Rule = p.name
+				m.findings = append(m.findings, f)
+			}
+			continue
+		}
+		for _, c := range m.changes {
+			if c.errState != nil {
+				continue
+			}
+			for _, f := range p.change(c) {
+				f.Rule = p.name
+				if f.DocPath == "" {
+					f.DocPath = c.docPath
+				}
+				m.findings = append(m.findings, f)
+			}
+		}
+	}
+}
+
+// checkPolicies returns an error if any policy rule raised a blocking finding.
+func (m *Migrator) checkPolicies() error {
+	blocking := []string{}
+	for _, f := range m.findings {
+		if f.Severity == SeverityError {
+			blocking = append(blocking, f.Rule)
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("Migration is blocked by %d policy findings from %s.", len(blocking), strings.Join(blocking, ", "))
+	}
+	return nil
+}
+
+// renderFindings returns the findings grouped by severity.
+func (m *Migrator) renderFindings() string {
+	if len(m.findings) == 0 {
+		return ""
+	}
+	out := "\nPolicy findings:\n"
+	for _, severity := range []Severity{SeverityError, SeverityWarning} {
+		for _, f := range m.findings {
+			if f.Severity != severity {
+				continue
+			}
+			line := fmt.Sprintf("  [%s] %s", f.Rule, f.Message)
+			if f.DocPath != "" {
+				line = fmt.Sprintf("  [%s] %s: %s", f.Rule, f.DocPath, f.Message)
+			}
+			if severity == SeverityError {
+				out += clrTheme().red("x"+line) + "\n"
+			} else {
+				out += clrTheme().yellow("!"+line) + "\n"
+			}
+		}
+	}
+	return out
+}
+
+// <---------------------- Built in rules ------------------------------------>
+
+// ForbidDelete blocks deleting any document whose path matches the pattern.
+func ForbidDelete(pattern string) ChangeRule {
+	pattern = strings.Trim(pattern, "/")
+	return func(c *Change) []Finding {
+		if c.Command() == MigratorDelete && matchPath(pattern, c.DocPath()) {
+			return []Finding{Block("documents matching %s may not be deleted", pattern)}
+		}
+		return nil
+	}
+}
+
+// ForbidFieldRemoval blocks removing the top level field from any document.
+func ForbidFieldRemoval(field string) ChangeRule {
+	return func(c *Change) []Finding {
+		if c.Command() == MigratorDelete {
+			if _, ok := c.Before()[field]; ok {
+				return []Finding{Block("field %s may not be removed", field)}
+			}
+			return nil
+		}
+		for _, fc := range c.Diff() {
+			if len(fc.Path) == 1 && fc.Path[0] == field && fc.Kind == DiffRemoved {
+				return []Finding{Block("field %s may not be removed", field)}
+			}
+		}
+		return nil
+	}
+}
+
+// MaxChanges blocks migrations with more than limit changes.
+func MaxChanges(limit int) MigrationRule {
+	return func(changes []*Change) []Finding {
+		if len(changes) > limit {
+			return []Finding{Block("%d changes exceed the limit of %d", len(changes), limit)}
+		}
+		return nil
+	}
+}
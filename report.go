@@ -0,0 +1,479 @@
+package fig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Plan is the reviewable form of a staged migration used by plan renderers.
+type Plan struct {
+	Name         string       `json:"name"`
+	DatabaseName string       `json:"databaseName"`
+	Environment  string       `json:"environment,omitempty"`
+	StoragePath  string       `json:"storagePath"`
+	PlanHash     string       `json:"planHash"`
+	HasRun       bool         `json:"hasRun"`
+	Generated    time.Time    `json:"generated"`
+	Findings     []Finding    `json:"findings,omitempty"`
+	Changes      []PlanChange `json:"changes"`
+}
+
+// PlanChange is one change within a Plan. Document values are serialized the same way as
+// WorkUnit patches.
+type PlanChange struct {
+	DocPath    string         `json:"docPath"`
+	Command    string         `json:"command"`
+	Before     map[string]any `json:"before"`
+	After      map[string]any `json:"after"`
+	Patch      map[string]any `json:"patch"`
+	Fields     []FieldChange  `json:"fields"`
+	Violations []Violation    `json:"violations,omitempty"`
+	Conditions []string       `json:"conditions,omitempty"`
+	Step       int            `json:"step,omitempty"`
+	Steps      int            `json:"steps,omitempty"`
+	Net        []FieldChange  `json:"net,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// PlanRenderer renders a Plan to one output format.
+type PlanRenderer interface {
+	Extension() string
+	Render(plan *Plan) ([]byte, error)
+}
+
+// defaultRenderers returns the built in plan renderers by format name.
+func defaultRenderers() map[string]PlanRenderer {
+	return map[string]PlanRenderer{
+		"json":     jsonRenderer{},
+		"markdown": markdownRenderer{},
+		"html":     htmlRenderer{},
+		"text":     textRenderer{},
+	}
+}
+
+// reportStore is implemented by stores which can save rendered reports as raw content.
+type reportStore interface {
+	saveReport(name string, content []byte) error
+}
+
+// SetRenderer adds or replaces the plan renderer for a format.
+func (m *Migrator) SetRenderer(format string, renderer PlanRenderer) {
+	if m.renderers == nil {
+		m.renderers = defaultRenderers()
+	}
+	m.renderers[format] = renderer
+}
+
+// renderer returns the plan renderer for a format.
+func (m *Migrator) renderer(format string) (PlanRenderer, error) {
+	if m.renderers == nil {
+		m.renderers = defaultRenderers()
+	}
+	r, ok := m.renderers[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown plan format %s.", format)
+	}
+	return r, nil
+}
+
+// buildPlan converts the solved changes to a Plan.
+func (m *Migrator) buildPlan() *Plan {
+	hash := m.presentHash()
+	plan := Plan{
+		Name:         m.name,
+		DatabaseName: m.database.name(),
+		Environment:  m.environment,
+		StoragePath:  m.storagePath,
+		PlanHash:     hash,
+		HasRun:       m.hasRun,
+		Generated:    time.Now(),
+		Findings:     m.findings,
+		Changes:      []PlanChange{},
+	}
+	for _, c := range m.changes {
+		pc := PlanChange{
+			DocPath: c.docPath,
+			Command: c.commandString(),
+			Patch:   serializeData(c.patch, m.database).(map[string]any),
+		}
+		for _, cond := range c.conditions {
+			pc.Conditions = append(pc.Conditions, cond.describe(m.database))
+		}
+		if c.steps > 1 {
+			pc.Step, pc.Steps = c.step, c.steps
+		}
+		if c.errState != nil {
+			pc.Error = c.errState.Error()
+		} else {
+			pc.Before, pc.After = c.beforeAfterCache()
+			for _, fc := range c.Diff() {
+				fc.Old = serializeData(fc.Old, m.database)
+				fc.New = serializeData(fc.New, m.database)
+				pc.Fields = append(pc.Fields, fc)
+			}
+			for _, fc := range c.net {
+				fc.Old = serializeData(fc.Old, m.database)
+				fc.New = serializeData(fc.New, m.database)
+				pc.Net = append(pc.Net, fc)
+			}
+			pc.Violations = c.violations
+		}
+		plan.Changes = append(plan.Changes, pc)
+	}
+	return &plan
+}
+
+// RenderMigration renders the staged migration in the given format.
+func (m *Migrator) RenderMigration(format string) ([]byte, error) {
+	r, err := m.renderer(format)
+	if err != nil {
+		return nil, err
+	}
+	return r.Render(m.buildPlan())
+}
+
+// SavePlan renders the staged migration in each format and saves the reports next to the
+// migration in the migration store as <name>_plan.<extension>.
+func (m *Migrator) SavePlan(formats ...string) error {
+	store, err := m.migrationStore()
+	if err != nil {
+		return err
+	}
+	plan := m.buildPlan()
+	for _, format := range formats {
+		r, err := m.renderer(format)
+		if err != nil {
+			return err
+		}
+		content, err := r.Render(plan)
+		if err != nil {
+			return err
+		}
+		name := m.name + "_plan." + r.Extension()
+		if rs, ok := store.(reportStore); ok {
+			err = rs.saveReport(name, content)
+		} else {
+			err = store.Save(m.name+"_plan_"+r.Extension(), Diff{Diff: string(content), Format: format})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// <---------------------- renderers ------------------------------------>
+
+// jsonRenderer renders the plan as structured json.
+type jsonRenderer struct{}
+
+func (jsonRenderer) Extension() string { return "json" }
+
+func (jsonRenderer) Render(plan *Plan) ([]byte, error) {
+	return json.MarshalIndent(plan, "", "  ")
+}
+
+// textRenderer renders the plan as plain text without terminal colors.
+type textRenderer struct{}
+
+func (textRenderer) Extension() string { return "txt" }
+
+func (textRenderer) Render(plan *Plan) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Migration Name:  %s\nDatabase:        %s\n", plan.Name, plan.DatabaseName)
+	if plan.Environment != "" {
+		fmt.Fprintf(&b, "Environment:     %s\n", strings.ToUpper(plan.Environment))
+	}
+	fmt.Fprintf(&b, "Plan Hash:       %s\nChanges:         %d\n", plan.PlanHash, len(plan.Changes))
+	for _, f := range plan.Findings {
+		fmt.Fprintf(&b, "%s [%s] %s %s\n", strings.ToUpper(string(f.Severity)), f.Rule, f.DocPath, f.Message)
+	}
+	for _, c := range plan.Changes {
+		fmt.Fprintf(&b, "\n%s >> [%s]\n", c.DocPath, strings.ToUpper(c.Command))
+		if c.Steps > 1 {
+			fmt.Fprintf(&b, "  STEP %d OF %d\n", c.Step, c.Steps)
+		}
+		if len(c.Conditions) > 0 {
+			fmt.Fprintf(&b, "  ONLY IF %s\n", strings.Join(c.Conditions, " and "))
+		}
+		if c.Error != "" {
+			fmt.Fprintf(&b, "  ERROR: %s\n", c.Error)
+			continue
+		}
+		if len(c.Fields) == 0 {
+			b.WriteString("  < no changes >\n")
+		}
+		for _, f := range c.Fields {
+			fmt.Fprintf(&b, "  %s %s: %s\n", fieldSymbol(f.Kind), f.PathString(), fieldValues(f))
+		}
+		if len(c.Net) > 0 {
+			fmt.Fprintf(&b, "  NET OVER %d STEPS\n", c.Steps)
+		}
+		for _, f := range c.Net {
+			fmt.Fprintf(&b, "  %s %s: %s\n", fieldSymbol(f.Kind), f.PathString(), fieldValues(f))
+		}
+		for _, v := range c.Violations {
+			fmt.Fprintf(&b, "  INVALID %s: %s\n", v.Path, v.Message)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// markdownRenderer renders the plan as markdown suitable for a pull request description.
+type markdownRenderer struct{}
+
+func (markdownRenderer) Extension() string { return "md" }
+
+func (markdownRenderer) Render(plan *Plan) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Migration `%s`\n\n", plan.Name)
+	fmt.Fprintf(&b, "| | |\n|---|---|\n| Database | `%s` |\n", plan.DatabaseName)
+	if plan.Environment != "" {
+		fmt.Fprintf(&b, "| Environment | **%s** |\n", strings.ToUpper(plan.Environment))
+	}
+	fmt.Fprintf(&b, "| Plan hash | `%s` |\n| Changes | %d |\n\n", plan.PlanHash, len(plan.Changes))
+
+	b.WriteString("## Summary\n\n| Command | Count |\n|---|---|\n")
+	for _, row := range planCounts(plan) {
+		fmt.Fprintf(&b, "| %s | %d |\n", row.name, row.count)
+	}
+
+	if len(plan.Findings) > 0 {
+		b.WriteString("\n## Policy Findings\n\n| Severity | Rule | Document | Message |\n|---|---|---|---|\n")
+		for _, f := range plan.Findings {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", f.Severity, f.Rule, markdownCell(f.DocPath), f.Message)
+		}
+	}
+
+	b.WriteString("\n## Changes\n")
+	for _, c := range plan.Changes {
+		fmt.Fprintf(&b, "\n### %s %s\n\n", markdownCode(c.DocPath), strings.ToUpper(c.Command))
+		if c.Steps > 1 {
+			fmt.Fprintf(&b, "Step %d of %d on this document\n\n", c.Step, c.Steps)
+		}
+		if len(c.Conditions) > 0 {
+			fmt.Fprintf(&b, "Only if `%s`\n\n", strings.Join(c.Conditions, "` and `"))
+		}
+		if c.Error != "" {
+			fmt.Fprintf(&b, "> **Error:** %s\n", c.Error)
+			continue
+		}
+		if len(c.Fields) == 0 {
+			b.WriteString("_No changes._\n")
+		} else {
+			b.WriteString("| Field | Change | Before | After |\n|---|---|---|---|\n")
+			for _, f := range c.Fields {
+				fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", markdownCell(f.PathString()), f.Kind, markdownValue(f.Old, f.Kind == DiffAdded), markdownValue(f.New, f.Kind == DiffRemoved))
+			}
+		}
+		if len(c.Net) > 0 {
+			fmt.Fprintf(&b, "\n**Net change over %d steps:**\n\n| Field | Change | Before | After |\n|---|---|---|---|\n", c.Steps)
+			for _, f := range c.Net {
+				fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", markdownCell(f.PathString()), f.Kind, markdownValue(f.Old, f.Kind == DiffAdded), markdownValue(f.New, f.Kind == DiffRemoved))
+			}
+		}
+		if len(c.Violations) > 0 {
+			b.WriteString("\n**Schema violations:**\n\n")
+			for _, v := range c.Violations {
+				fmt.Fprintf(&b, "- %s: %s\n", markdownCode(v.Path), v.Message)
+			}
+		}
+		before, _ := json.MarshalIndent(c.Before, "", "  ")
+		after, _ := json.MarshalIndent(c.After, "", "  ")
+		fence := markdownFence(string(before) + string(after))
+		fmt.Fprintf(&b, "\n<details><summary>Documents</summary>\n\nBefore:\n%[1]sjson\n%[2]s\n%[1]s\n\nAfter:\n%[1]sjson\n%[3]s\n%[1]s\n</details>\n", fence, before, after)
+	}
+	return b.Bytes(), nil
+}
+
+// htmlRenderer renders the plan as a self contained html report with collapsible diffs.
+type htmlRenderer struct{}
+
+func (htmlRenderer) Extension() string { return "html" }
+
+func (htmlRenderer) Render(plan *Plan) ([]byte, error) {
+	type htmlChange struct {
+		PlanChange
+		BeforeJSON string
+		AfterJSON  string
+	}
+	changes := []htmlChange{}
+	for _, c := range plan.Changes {
+		before, _ := json.MarshalIndent(c.Before, "", "  ")
+		after, _ := json.MarshalIndent(c.After, "", "  ")
+		changes = append(changes, htmlChange{c, string(before), string(after)})
+	}
+	var b bytes.Buffer
+	err := htmlReport.Execute(&b, map[string]any{
+		"Plan":    plan,
+		"Counts":  planCounts(plan),
+		"Changes": changes,
+	})
+	return b.Bytes(), err
+}
+
+var htmlReport = template.Must(template.New("plan").Funcs(template.FuncMap{
+	"upper": strings.ToUpper,
+	"value": func(v any) string {
+		js, _ := json.Marshal(v)
+		return string(js)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Migration {{.Plan.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin: 0.5em 0; }
+td, th { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; vertical-align: top; }
+pre { background: #f6f8fa; padding: 0.5em; overflow-x: auto; }
+.env { color: #fff; background: #c00; padding: 0.25em 0.5em; font-weight: bold; }
+.added { background: #e6ffed; }
+.removed { background: #ffeef0; }
+.modified, .typeChanged { background: #fff5b1; }
+.error { color: #c00; font-weight: bold; }
+.warning { color: #a60; }
+.sides { display: flex; gap: 1em; }
+.sides > div { flex: 1; min-width: 0; }
+</style>
+</head>
+<body>
+<h1>Migration <code>{{.Plan.Name}}</code></h1>
+{{if .Plan.Environment}}<p><span class="env">{{upper .Plan.Environment}}</span></p>{{end}}
+<table>
+<tr><th>Database</th><td><code>{{.Plan.DatabaseName}}</code></td></tr>
+<tr><th>Plan hash</th><td><code>{{.Plan.PlanHash}}</code></td></tr>
+<tr><th>Has run</th><td>{{.Plan.HasRun}}</td></tr>
+<tr><th>Changes</th><td>{{len .Plan.Changes}}</td></tr>
+</table>
+<h2>Summary</h2>
+<table>
+<tr><th>Command</th><th>Count</th></tr>
+{{range .Counts}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{if .Plan.Findings}}<h2>Policy Findings</h2>
+<table>
+<tr><th>Severity</th><th>Rule</th><th>Document</th><th>Message</th></tr>
+{{range .Plan.Findings}}<tr class="{{.Severity}}"><td>{{.Severity}}</td><td>{{.Rule}}</td><td><code>{{.DocPath}}</code></td><td>{{.Message}}</td></tr>
+{{end}}</table>{{end}}
+<h2>Changes</h2>
+{{range .Changes}}<details>
+<summary><code>{{.DocPath}}</code> {{upper .Command}}</summary>
+{{if .Steps}}<p>Step {{.Step}} of {{.Steps}} on this document</p>{{end}}
+{{if .Conditions}}<p>Only if {{range $i, $c := .Conditions}}{{if $i}} and {{end}}<code>{{$c}}</code>{{end}}</p>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{else}}{{if .Fields}}<table>
+<tr><th>Field</th><th>Change</th><th>Before</th><th>After</th></tr>
+{{range .Fields}}<tr class="{{.Kind}}"><td><code>{{.PathString}}</code></td><td>{{.Kind}}</td><td><code>{{if ne .Kind.String "added"}}{{value .Old}}{{end}}</code></td><td><code>{{if ne .Kind.String "removed"}}{{value .New}}{{end}}</code></td></tr>
+{{end}}</table>{{else}}<p>No changes.</p>{{end}}
+{{if .Net}}<h4>Net change over {{.Steps}} steps</h4><table>
+<tr><th>Field</th><th>Change</th><th>Before</th><th>After</th></tr>
+{{range .Net}}<tr class="{{.Kind}}"><td><code>{{.PathString}}</code></td><td>{{.Kind}}</td><td><code>{{if ne .Kind.String "added"}}{{value .Old}}{{end}}</code></td><td><code>{{if ne .Kind.String "removed"}}{{value .New}}{{end}}</code></td></tr>
+{{end}}</table>{{end}}
+{{if .Violations}}<ul class="error">{{range .Violations}}<li><code>{{.Path}}</code>: {{.Message}}</li>
+{{end}}</ul>{{end}}
+<div class="sides"><div><h4>Before</h4><pre>{{.BeforeJSON}}</pre></div><div><h4>After</h4><pre>{{.AfterJSON}}</pre></div></div>{{end}}
+</details>
+{{end}}</body>
+</html>
+`))
+
+// planCount is one row of a plan summary.
+type planCount struct {
+	name  string
+	count int
+}
+
+func (p planCount) Name() string { return p.name }
+func (p planCount) Count() int   { return p.count }
+
+// planCounts returns the number of changes per command, sorted by command.
+func planCounts(plan *Plan) []planCount {
+	counts := map[string]int{}
+	for _, c := range plan.Changes {
+		counts[c.Command]++
+	}
+	rows := []planCount{}
+	for k, v := range counts {
+		rows = append(rows, planCount{k, v})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].name < rows[j].name })
+	return rows
+}
+
+// fieldSymbol returns the diff symbol for a field change kind.
+func fieldSymbol(kind DiffKind) string {
+	switch kind {
+	case DiffAdded:
+		return "+"
+	case DiffRemoved:
+		return "-"
+	case DiffModified:
+		return "~"
+	default:
+		return "!"
+	}
+}
+
+// fieldValues returns the old and new serialized values of a field change as text.
+func fieldValues(f FieldChange) string {
+	before, _ := json.Marshal(f.Old)
+	after, _ := json.Marshal(f.New)
+	switch f.Kind {
+	case DiffAdded:
+		return string(after)
+	case DiffRemoved:
+		return string(before)
+	default:
+		return string(before) + " -> " + string(after)
+	}
+}
+
+// markdownValue formats a value for a markdown table cell.
+func markdownValue(v any, empty bool) string {
+	if empty {
+		return ""
+	}
+	js, _ := json.Marshal(v)
+	return markdownCell(string(js))
+}
+
+// markdownCell formats text as a code span for a markdown table cell, where a pipe would
+// otherwise end the cell.
+func markdownCell(s string) string {
+	return markdownCode(strings.ReplaceAll(s, "|", `\|`))
+}
+
+// markdownCode formats text as a code span. The span is delimited by a backtick run longer
+// than any in the text, padded with spaces when the text starts or ends with a backtick.
+func markdownCode(s string) string {
+	delim := strings.Repeat("`", longestBackticks(s)+1)
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return delim + s + delim
+}
+
+// markdownFence returns a code block fence longer than any backtick run in the text.
+func markdownFence(s string) string {
+	return strings.Repeat("`", maxNum(3, longestBackticks(s)+1))
+}
+
+// longestBackticks returns the length of the longest run of backticks in s.
+func longestBackticks(s string) int {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r != '`' {
+			run = 0
+			continue
+		}
+		run++
+		longest = maxNum(longest, run)
+	}
+	return longest
+}
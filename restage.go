@@ -0,0 +1,208 @@
+package fig
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// StagePolicy is an enum of how staging a change for a document which already has a staged
+// change is resolved.
+type StagePolicy int
+
+const (
+	// StageReplace replaces the staged change with the new one.
+	StageReplace StagePolicy = iota
+	// StageMergePatches merges the new patch into the staged change's patch.
+	StageMergePatches
+	// StageError refuses the new change.
+	StageError
+	// StageCompose keeps both changes. The new change is applied after the staged one.
+	StageCompose
+)
+
+// SetStagePolicy sets how a second change staged against the same document is resolved.
+// The default StageReplace makes re-running a staging script idempotent. A replacement
+// which drops a different change is reported as a warning finding by PrepMigration.
+func (m *Migrator) SetStagePolicy(policy StagePolicy) {
+	m.stagePolicy = policy
+}
+
+// restage adds a change, resolving it against any change already staged for the document.
+// A replaced change takes the place of every change on the document and a merged change
+// takes the place of the last one.
+func (m *Migrator) restage(change *Change) error {
+	i := -1
+	for k, c := range m.changes {
+		if c.docPath == change.docPath {
+			i = k
+		}
+	}
+	if i < 0 || m.stagePolicy == StageCompose {
+		m.changes = append(m.changes, change)
+		return nil
+	}
+
+	switch m.stagePolicy {
+	case StageError:
+		return fmt.Errorf("A change is already staged for %s.", change.docPath)
+	case StageMergePatches:
+		merged, err := mergeChanges(m.changes[i], change)
+		if err != nil {
+			return err
+		}
+		m.changes[i] = merged
+	default:
+		kept := []*Change{}
+		for _, c := range m.changes {
+			if c.docPath != change.docPath {
+				kept = append(kept, c)
+				continue
+			}
+			if c == m.changes[i] {
+				kept = append(kept, change)
+			}
+			if !sameStaged(c, change) {
+				if m.replaced == nil {
+					m.replaced = map[string]bool{}
+				}
+				m.replaced[c.docPath] = true
+			}
+		}
+		m.changes = kept
+	}
+	return nil
+}
+
+// sameStaged reports whether two changes stage the same command and patch, as a staging
+// script run again does.
+func sameStaged(a *Change, b *Change) bool {
+	return a.command == b.command && reflect.DeepEqual(a.patch, b.patch)
+}
+
+// replacedFindings returns a warning for each document whose earlier staged change was
+// dropped by StageReplace and which still has a change staged.
+func (m *Migrator) replacedFindings() []Finding {
+	findings := []Finding{}
+	warned := map[string]bool{}
+	for _, c := range m.changes {
+		if !m.replaced[c.docPath] || warned[c.docPath] {
+			continue
+		}
+		warned[c.docPath] = true
+		f := Warn("An earlier change staged for this document was replaced. Use StageCompose or StageMergePatches to keep both.")
+		f.Rule = "stage-replace"
+		f.DocPath = c.docPath
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// mergeChanges returns a change combining the patch of next into the patch of prev. A delete
+// on either side is replaced by the newer change. A later Update is merged into an earlier
+// Set or Add, which keeps its command. Field path patches merge path by path.
+func mergeChanges(prev *Change, next *Change) (*Change, error) {
+	if prev.command == MigratorDelete || next.command == MigratorDelete {
+		return next, nil
+	}
+	command := next.command
+	switch {
+	case prev.command == next.command:
+	case next.command == MigratorUpdate && (prev.command == MigratorSet || prev.command == MigratorAdd):
+		command = prev.command
+	case next.command == MigratorSet:
+		return next, nil
+	default:
+		return nil, fmt.Errorf("Cannot merge %s into the %s staged for %s.", next.commandString(), prev.commandString(), next.docPath)
+	}
+
+	var patch map[string]any
+	if command == MigratorUpdateFields || command == MigratorSetMerge {
+		patch = map[string]any{}
+		for k, v := range prev.patch {
+			patch[k] = v
+		}
+		for k, v := range next.patch {
+			patch[k] = v
+		}
+	} else {
+		patch = mergeMaps(prev.patch, next.patch)
+	}
+	if command == MigratorSet || command == MigratorAdd {
+		// a field deleted by the update is simply left out of the document written
+		patch = withoutDeletes(patch, prev.database)
+	}
+
+	merged := NewChange(prev.docPath, prev.staged, patch, command, prev.database)
+	merged.fields = prev.fields
+	for _, field := range next.fields {
+		if !containsPath(merged.fields, field) {
+			merged.fields = append(merged.fields, field)
+		}
+	}
+	if command == MigratorUpdateFields {
+		updates, err := patchFieldUpdates(patch)
+		if err != nil {
+			return nil, err
+		}
+		paths := [][]string{}
+		for _, u := range updates {
+			paths = append(paths, u.Path)
+		}
+		if err := checkFieldPaths(paths); err != nil {
+			return nil, err
+		}
+	} else if err := checkFieldPaths(merged.fields); err != nil {
+		return nil, err
+	}
+	merged.conditions = prev.conditions
+	if len(next.conditions) > 0 {
+		merged.conditions = next.conditions
+	}
+	return merged, nil
+}
+
+// mergeMaps deep merges patch into base without modifying either.
+func mergeMaps(base map[string]any, patch map[string]any) map[string]any {
+	out := map[string]any{}
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range patch {
+		pm, pok := v.(map[string]any)
+		bm, bok := out[k].(map[string]any)
+		if pok && bok {
+			out[k] = mergeMaps(bm, pm)
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// containsPath reports whether the field path is in the list.
+func containsPath(paths [][]string, path []string) bool {
+	want := (FieldChange{Path: path}).PathString()
+	for _, p := range paths {
+		if (FieldChange{Path: p}).PathString() == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Regenerate reads every before value again from the live database and solves every change
+// again, so a migration staged or stored days ago shows an accurate diff and rollback.
+func (m *Migrator) Regenerate() error {
+	if m.hasRun {
+		return errors.New("Migration has already run. Its before values are the record of what it changed.")
+	}
+	for _, c := range m.changes {
+		before, err := m.database.getDocData(c.docPath)
+		if err != nil {
+			return err
+		}
+		c.staged = before
+	}
+	return m.PrepMigration()
+}
@@ -0,0 +1,107 @@
+package fig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// reviewHelp lists the review commands.
+const reviewHelp = "a: accept  s: skip  e: edit  c: accept rest of collection  A: accept all remaining  q: skip all remaining"
+
+// ReviewResult lists the docPaths of the changes accepted and skipped in a review.
+type ReviewResult struct {
+	Accepted []string
+	Skipped  []string
+}
+
+// ReviewMigration walks through the staged changes one at a time so each can be accepted,
+// skipped or edited. Skipped changes are removed from the Migrator, so neither the run nor the
+// rollback includes them. Commands are read from in and changes are written to out.
+func (m *Migrator) ReviewMigration(in io.Reader, out io.Writer) ReviewResult {
+	result := ReviewResult{Accepted: []string{}, Skipped: []string{}}
+	accepted := []*Change{}
+	acceptCollection := map[string]bool{}
+	acceptAll, skipAll := false, false
+
+	for i := 0; i < len(m.changes); i++ {
+		c := m.changes[i]
+		decision := ""
+		switch {
+		case acceptAll || acceptCollection[c.collectionPath()]:
+			decision = "a"
+		case skipAll:
+			decision = "s"
+		}
+
+		for decision == "" {
+			fmt.Fprint(out, m.renderChange(c, false))
+			fmt.Fprintf(out, "\n[ review %d/%d ]  %s\n", i+1, len(m.changes), reviewHelp)
+			line, err := readLine(in)
+			if err != nil && line == "" {
+				line = "q"
+			}
+			switch line {
+			case "a", "s":
+				decision = line
+			case "c":
+				acceptCollection[c.collectionPath()] = true
+				decision = "a"
+			case "A":
+				acceptAll = true
+				decision = "a"
+			case "q":
+				skipAll = true
+				decision = "s"
+			case "e":
+				if err := m.editChange(c, in, out); err != nil {
+					fmt.Fprintln(out, "EditError: "+err.Error())
+				}
+			default:
+				fmt.Fprintf(out, "< unknown command %s >\n", line)
+			}
+		}
+
+		if decision == "a" && c.errState == nil {
+			accepted = append(accepted, c)
+			result.Accepted = append(result.Accepted, c.docPath)
+		} else {
+			result.Skipped = append(result.Skipped, c.docPath)
+		}
+	}
+
+	m.changes = accepted
+	m.PrepMigration()
+	// the accepted changes are the plan approved to run
+	m.presentHash()
+	return result
+}
+
+// editChange replaces the patch of a change with json read from in and prepares the migration
+// again, so the edit is validated and checked against the policy rules.
+// Complex types use the serialized forms documented for migration files.
+func (m *Migrator) editChange(c *Change, in io.Reader, out io.Writer) error {
+	current, _ := json.Marshal(serializeData(c.patch, m.database))
+	fmt.Fprintf(out, "Current patch:\n%s\nEnter the replacement patch as json on one line:\n", current)
+	line, err := readLine(in)
+	if err != nil && line == "" {
+		return err
+	}
+	var patch map[string]any
+	if err := json.Unmarshal([]byte(line), &patch); err != nil {
+		return err
+	}
+	c.patch = deSerializeData(patch, m.database).(map[string]any)
+	m.PrepMigration()
+	return c.errState
+}
+
+// Present returns the summary shown for final confirmation after a review.
+func (r ReviewResult) Present() string {
+	out := fmt.Sprintf("Accepted:	  %d\nSkipped:	  %d\n", len(r.Accepted), len(r.Skipped))
+	if len(r.Skipped) > 0 {
+		out += "\nSkipped changes:\n  " + strings.Join(r.Skipped, "\n  ") + "\n"
+	}
+	return out
+}
@@ -0,0 +1,467 @@
+package fig
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Schema validates the after value of a document staged by a migration.
+type Schema interface {
+	Validate(doc map[string]any) []Violation
+}
+
+// Violation is one way a document fails its schema.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// schemaRule pairs a collection path pattern with the schema for matching documents.
+type schemaRule struct {
+	pattern string
+	schema  Schema
+}
+
+// RegisterSchema validates every document whose path matches the pattern. In a pattern, *
+// matches one path segment and ** matches any number of trailing segments, so users/* matches
+// user documents and users/*/orders/* matches their orders.
+func (m *Migrator) RegisterSchema(pattern string, schema Schema) {
+	m.schemas = append(m.schemas, schemaRule{pattern: strings.Trim(pattern, "/"), schema: schema})
+}
+
+// SetAllowInvalid lets RunMigration run changes which violate their schemas.
+func (m *Migrator) SetAllowInvalid(allow bool) {
+	m.allowInvalid = allow
+}
+
+// validateSchemas checks the after value of each solved change against the matching schemas.
+func (m *Migrator) validateSchemas() {
+	for _, c := range m.changes {
+		c.violations = nil
+		if c.errState != nil || c.command == MigratorDelete {
+			continue
+		}
+		for _, rule := range m.schemas {
+			if matchPath(rule.pattern, c.docPath) {
+				c.violations = append(c.violations, rule.schema.Validate(withoutDeletes(c.after, m.database))...)
+			}
+		}
+	}
+}
+
+// withoutDeletes returns a copy of data without the fields set to the delete sentinel, which
+// an Update after value still holds for the fields it removes.
+func withoutDeletes(data map[string]any, f figFirestore) map[string]any {
+	out := map[string]any{}
+	for k, v := range data {
+		if isDeleteValue(v, f) {
+			continue
+		}
+		if m, ok := v.(map[string]any); ok {
+			v = withoutDeletes(m, f)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// matchPath reports whether a document path matches a pattern.
+func matchPath(pattern string, docPath string) bool {
+	p := strings.Split(pattern, "/")
+	d := strings.Split(strings.Trim(docPath, "/"), "/")
+	for i, seg := range p {
+		if seg == "**" {
+			return true
+		}
+		if i >= len(d) || (seg != "*" && seg != d[i]) {
+			return false
+		}
+	}
+	return len(p) == len(d)
+}
+
+// <---------------------- JSON Schema ------------------------------------>
+
+// jsonSchema is the supported subset of JSON Schema. Firestore timestamps and references
+// may be matched with the extra types timestamp and reference, and timestamps also satisfy
+// string with format date-time.
+type jsonSchema struct {
+	Type                 any                    `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []any                  `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Pattern              string                 `json:"pattern"`
+	Format               string                 `json:"format"`
+	pattern              *regexp.Regexp
+}
+
+// NewJSONSchema parses a JSON Schema document.
+func NewJSONSchema(raw []byte) (Schema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// compile prepares the patterns of the schema and its subschemas.
+func (s *jsonSchema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// Validate checks a document against the schema.
+func (s *jsonSchema) Validate(doc map[string]any) []Violation {
+	violations := []Violation{}
+	s.validate(doc, []string{}, &violations)
+	return violations
+}
+
+// types returns the allowed types of the schema.
+func (s *jsonSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := []string{}
+		for _, v := range t {
+			if str, ok := v.(string); ok {
+				types = append(types, str)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// validate appends the violations of a value at the given path.
+func (s *jsonSchema) validate(v any, path []string, out *[]Violation) {
+	report := func(format string, a ...any) {
+		*out = append(*out, Violation{Path: FieldChange{Path: path}.PathString(), Message: fmt.Sprintf(format, a...)})
+	}
+
+	if types := s.types(); len(types) > 0 {
+		ok := false
+		for _, t := range types {
+			ok = ok || s.typeMatches(t, v)
+		}
+		if !ok {
+			report("expected %s but found %s", strings.Join(types, " or "), valueType(v))
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || (valueType(e) == valueType(v) && equalValues(e, v))
+		}
+		if !ok {
+			report("value is not one of the allowed values")
+		}
+	}
+
+	switch valueType(v) {
+	case "number":
+		n := toFloat(v)
+		if s.Minimum != nil && n < *s.Minimum {
+			report("%v is less than the minimum %v", n, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			report("%v is greater than the maximum %v", n, *s.Maximum)
+		}
+	case "string":
+		str := v.(string)
+		if s.MinLength != nil && len([]rune(str)) < *s.MinLength {
+			report("shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && len([]rune(str)) > *s.MaxLength {
+			report("longer than %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			report("does not match pattern %s", s.Pattern)
+		}
+	case "array":
+		items := toSliceAny(v)
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			report("fewer than %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			report("more than %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				s.Items.validate(item, appendPath(path, fmt.Sprint(i)), out)
+			}
+		}
+	case "map":
+		fields := toMapAny(v)
+		for _, r := range s.Required {
+			if _, ok := fields[r]; !ok {
+				*out = append(*out, Violation{Path: FieldChange{Path: appendPath(path, r)}.PathString(), Message: "required field is missing"})
+			}
+		}
+		for _, k := range sortedKeys(fields) {
+			if p, ok := s.Properties[k]; ok {
+				p.validate(fields[k], appendPath(path, k), out)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*out = append(*out, Violation{Path: FieldChange{Path: appendPath(path, k)}.PathString(), Message: "field is not allowed"})
+			}
+		}
+	}
+}
+
+// typeMatches reports whether a value is of the named JSON Schema type.
+func (s *jsonSchema) typeMatches(t string, v any) bool {
+	vt := valueType(v)
+	switch t {
+	case "object":
+		return vt == "map"
+	case "integer":
+		return vt == "number" && toFloat(v) == math.Trunc(toFloat(v))
+	case "string":
+		return vt == "string" || ((vt == "timestamp" || vt == "serverTimestamp") && s.Format == "date-time")
+	case "timestamp":
+		return vt == "timestamp" || vt == "serverTimestamp"
+	default:
+		return vt == t
+	}
+}
+
+// <---------------------- Struct Schema ------------------------------------>
+
+// structSchema validates documents against the fields of a Go struct.
+type structSchema struct {
+	typ reflect.Type
+}
+
+// NewStructSchema returns a Schema built from a Go struct using its firestore tags. Documents
+// may not hold fields the struct does not declare, field values must be assignable to the
+// struct field types, and fields not tagged omitempty are required.
+func NewStructSchema(model any) (Schema, error) {
+	t := reflect.TypeOf(model)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Struct schema needs a struct but got %T.", model)
+	}
+	return structSchema{typ: t}, nil
+}
+
+// Validate checks a document against the struct.
+func (s structSchema) Validate(doc map[string]any) []Violation {
+	violations := []Violation{}
+	validateStruct(s.typ, doc, []string{}, &violations)
+	return violations
+}
+
+// structField is a document field declared by a struct. Index locates the field through any
+// embedded structs for reflect.Value.FieldByIndex.
+type structField struct {
+	name            string
+	typ             reflect.Type
+	index           []int
+	omitempty       bool
+	serverTimestamp bool
+}
+
+// structFields returns the document fields declared by a struct type, flattening embedded
+// structs the same way the Firestore client does.
+func structFields(t reflect.Type) []structField {
+	fields := []structField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("firestore")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		embedded := f.Type
+		if embedded.Kind() == reflect.Pointer {
+			embedded = embedded.Elem()
+		}
+		if f.Anonymous && opts[0] == "" && embedded.Kind() == reflect.Struct && embedded != reflect.TypeOf(time.Time{}) {
+			for _, embedded := range structFields(embedded) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		sf := structField{name: f.Name, typ: f.Type, index: []int{i}}
+		if opts[0] != "" {
+			sf.name = opts[0]
+		}
+		for _, o := range opts[1:] {
+			switch o {
+			case "omitempty":
+				sf.omitempty = true
+			case "serverTimestamp":
+				sf.serverTimestamp = true
+			}
+		}
+		fields = append(fields, sf)
+	}
+	return fields
+}
+
+// validateStruct appends the violations of a document against a struct type.
+func validateStruct(t reflect.Type, doc map[string]any, path []string, out *[]Violation) {
+	declared := map[string]bool{}
+	for _, f := range structFields(t) {
+		declared[f.name] = true
+		v, ok := doc[f.name]
+		if !ok {
+			if !f.omitempty && !f.serverTimestamp {
+				*out = append(*out, Violation{Path: FieldChange{Path: appendPath(path, f.name)}.PathString(), Message: "required field is missing"})
+			}
+			continue
+		}
+		validateValue(f.typ, v, appendPath(path, f.name), out)
+	}
+	for _, k := range sortedKeys(doc) {
+		if !declared[k] {
+			*out = append(*out, Violation{Path: FieldChange{Path: appendPath(path, k)}.PathString(), Message: "field is not declared by " + t.Name()})
+		}
+	}
+}
+
+// validateValue appends a violation if a document value cannot be assigned to a Go type.
+func validateValue(t reflect.Type, v any, path []string, out *[]Violation) {
+	report := func() {
+		*out = append(*out, Violation{Path: FieldChange{Path: path}.PathString(), Message: fmt.Sprintf("%s cannot hold %s", t.String(), valueType(v))})
+	}
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			return
+		}
+		report()
+		return
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		if valueType(v) != "timestamp" && valueType(v) != "serverTimestamp" {
+			report()
+		}
+		return
+	case reflect.TypeOf(&firestore.DocumentRef{}):
+		if valueType(v) != "reference" {
+			report()
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		validateValue(t.Elem(), v, path, out)
+	case reflect.Interface:
+		return
+	case reflect.String:
+		if valueType(v) != "string" {
+			report()
+		}
+	case reflect.Bool:
+		if valueType(v) != "boolean" {
+			report()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if valueType(v) != "number" || toFloat(v) != math.Trunc(toFloat(v)) {
+			report()
+		}
+	case reflect.Float32, reflect.Float64:
+		if valueType(v) != "number" {
+			report()
+		}
+	case reflect.Struct:
+		if valueType(v) != "map" {
+			report()
+			return
+		}
+		validateStruct(t, toMapAny(v), path, out)
+	case reflect.Map:
+		if valueType(v) != "map" {
+			report()
+			return
+		}
+		items := toMapAny(v)
+		for _, k := range sortedKeys(items) {
+			validateValue(t.Elem(), items[k], appendPath(path, k), out)
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && valueType(v) == "bytes" {
+			return
+		}
+		if valueType(v) != "array" {
+			report()
+			return
+		}
+		for i, item := range toSliceAny(v) {
+			validateValue(t.Elem(), item, appendPath(path, fmt.Sprint(i)), out)
+		}
+	}
+}
+
+// checkSchemas returns an error if any staged change violates its schema, unless invalid
+// changes are allowed.
+func (m *Migrator) checkSchemas() error {
+	if m.allowInvalid {
+		return nil
+	}
+	count := 0
+	for _, c := range m.changes {
+		if len(c.violations) > 0 {
+			count++
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("%d changes violate their schemas. Fix them or allow invalid changes to run anyway.", count)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in order so violations are reported deterministically.
+func sortedKeys(data map[string]any) []string {
+	keys := []string{}
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,224 @@
+package fig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MigrationStore persists migrations, rollbacks and other GoFig records by name. Names
+// beginning with an underscore are internal records and are not listed.
+type MigrationStore interface {
+	List() ([]string, error)
+	Load(name string, target any) error
+	Save(name string, target any) error
+	Delete(name string) error
+}
+
+// opsStore is implemented by stores which hold the execution lock and the audit log natively.
+// Stores which do not implement it fall back to records saved through the MigrationStore API.
+type opsStore interface {
+	leases() leaseStore
+	appendAudit(report *RunReport) error
+}
+
+// openStore selects a MigrationStore from a storage path. Supported forms are file://dir,
+// firestore://collection, s3://bucket/prefix and the legacy [firestore]/collection. Any
+// other path is treated as a local directory.
+func openStore(storagePath string, db figFirestore) (MigrationStore, error) {
+	switch {
+	case strings.HasPrefix(storagePath, "file://"):
+		return FileStore{Dir: strings.TrimPrefix(storagePath, "file://")}, nil
+	case strings.HasPrefix(storagePath, "firestore://"):
+		return firestoreStore{db: db, colPath: strings.Trim(strings.TrimPrefix(storagePath, "firestore://"), "/")}, nil
+	case strings.HasPrefix(storagePath, "[firestore]/"):
+		return firestoreStore{db: db, colPath: strings.Trim(strings.TrimPrefix(storagePath, "[firestore]/"), "/")}, nil
+	case strings.HasPrefix(storagePath, "s3://"):
+		return objectStoreFromURL(storagePath)
+	case strings.Contains(storagePath, "://"):
+		u, _ := url.Parse(storagePath)
+		if u != nil {
+			return nil, fmt.Errorf("Unsupported storage scheme %s.", u.Scheme)
+		}
+		return nil, errors.New("Invalid storage path.")
+	}
+	return FileStore{Dir: storagePath}, nil
+}
+
+// <---------------------- FileStore ------------------------------------>
+
+// FileStore keeps each record as a json file in a local directory.
+type FileStore struct {
+	Dir string
+}
+
+// List returns the names of the json files in the directory.
+func (s FileStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "_") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(name, ".json"))
+	}
+	return names, nil
+}
+
+// Load reads the named json file into target.
+func (s FileStore) Load(name string, target any) error {
+	return loadJson(filepath.Join(s.Dir, name), target)
+}
+
+// Save writes target to the named json file.
+func (s FileStore) Save(name string, target any) error {
+	return storeJson(target, s.Dir, name)
+}
+
+// Delete removes the named json file.
+func (s FileStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.Dir, name+".json"))
+}
+
+func (s FileStore) leases() leaseStore {
+	return fileLease{path: filepath.Join(s.Dir, lockName+".json")}
+}
+
+// appendAudit appends the report to a json lines file.
+func (s FileStore) appendAudit(report *RunReport) error {
+	js, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, auditName+".jsonl")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(js, '\n'))
+	return err
+}
+
+// saveReport writes raw report content next to the migrations.
+func (s FileStore) saveReport(name string, content []byte) error {
+	return os.WriteFile(filepath.Join(s.Dir, name), content, 0644)
+}
+
+// <---------------------- firestoreStore ------------------------------------>
+
+// firestoreStore keeps each record as a document in a collection on the database.
+type firestoreStore struct {
+	db      figFirestore
+	colPath string
+}
+
+// List returns the ids of the documents in the collection.
+func (s firestoreStore) List() ([]string, error) {
+	paths, err := s.db.listDocPaths(s.colPath)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, p := range paths {
+		name := p[strings.LastIndex(p, "/")+1:]
+		if !strings.HasPrefix(name, "_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Load reads the named document into target.
+func (s firestoreStore) Load(name string, target any) error {
+	return s.db.getDocStruct(target, s.colPath+"/"+name)
+}
+
+// Save writes target to the named document.
+func (s firestoreStore) Save(name string, target any) error {
+	return s.db.setDocStruct(target, s.colPath+"/"+name)
+}
+
+// Delete removes the named document.
+func (s firestoreStore) Delete(name string) error {
+	return s.db.deleteDoc(s.colPath + "/" + name)
+}
+
+func (s firestoreStore) leases() leaseStore {
+	return dbLease{db: s.db, docPath: s.colPath + "/" + lockName}
+}
+
+// appendAudit creates a new document in the audit subcollection. Audit documents are only ever created.
+func (s firestoreStore) appendAudit(report *RunReport) error {
+	path, err := s.db.genDocPath(s.colPath + "/" + auditName + "/runs")
+	if err != nil {
+		return err
+	}
+	return s.db.setDocStruct(report, path)
+}
+
+// <---------------------- fallbacks ------------------------------------>
+
+// savedLease keeps the lock as a record in a MigrationStore which has no native locking.
+// Claims are not atomic so two runs starting at the same instant may both succeed.
+type savedLease struct {
+	store MigrationStore
+}
+
+func (s savedLease) claimLease(l lease, now time.Time) error {
+	var held lease
+	if err := s.store.Load(lockName, &held); err == nil && held.Owner != "" {
+		if held.Owner != l.Owner && now.Before(held.Expires) {
+			return held.lockedError()
+		}
+	}
+	return s.store.Save(lockName, l)
+}
+
+func (s savedLease) renewLease(l lease) error {
+	var held lease
+	if err := s.store.Load(lockName, &held); err != nil || held.Owner != l.Owner {
+		return errors.New("Migration lock was lost.")
+	}
+	return s.store.Save(lockName, l)
+}
+
+func (s savedLease) releaseLease(owner string) error {
+	var held lease
+	if err := s.store.Load(lockName, &held); err != nil {
+		return nil
+	}
+	if owner != "" && held.Owner != owner {
+		return nil
+	}
+	return s.store.Delete(lockName)
+}
+
+// storeLeases returns the lease store for a MigrationStore.
+func storeLeases(store MigrationStore) leaseStore {
+	if ops, ok := store.(opsStore); ok {
+		return ops.leases()
+	}
+	return savedLease{store: store}
+}
+
+// storeAudit appends a run report to the audit log of a MigrationStore. Stores without a
+// native audit log receive one record per run.
+func storeAudit(store MigrationStore, report *RunReport) error {
+	if ops, ok := store.(opsStore); ok {
+		return ops.appendAudit(report)
+	}
+	name := fmt.Sprintf("%s_%s_%s", auditName, report.Started.UTC().Format("20060102T150405.000000000Z"), report.Migration)
+	return store.Save(name, report)
+}
@@ -0,0 +1,192 @@
+package fig
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Export is a portable copy of the documents of a collection. Document data is encoded with
+// the type of every value like a Backup, so integers, doubles and timestamps import exactly.
+// References into the exported database stay relative, so an export can be loaded into
+// another environment.
+type Export struct {
+	Collection   string      `json:"collection"`
+	Recursive    bool        `json:"recursive"`
+	DatabaseName string      `json:"databaseName,omitempty"`
+	Exported     time.Time   `json:"exported"`
+	Documents    []ExportDoc `json:"documents"`
+}
+
+// ExportDoc is one document in an Export.
+type ExportDoc struct {
+	DocPath string         `json:"docPath"`
+	Data    map[string]any `json:"data"`
+}
+
+// SyncSource provides the documents a sync makes a collection match. Document data is encoded
+// with the type of every value, the same way as in an Export. With recursive, documents in
+// subcollections at any depth are included.
+type SyncSource interface {
+	ReadCollection(colPath string, recursive bool) ([]ExportDoc, error)
+}
+
+// LoadExport reads an Export from a json file so it can be used as a SyncSource.
+func LoadExport(path string) (*Export, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e Export
+	if err := json.Unmarshal(content, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ReadCollection returns the exported documents within the collection.
+func (e *Export) ReadCollection(colPath string, recursive bool) ([]ExportDoc, error) {
+	docs := []ExportDoc{}
+	for _, d := range e.Documents {
+		if inCollection(d.DocPath, colPath, recursive) {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+// databaseSource reads a collection from a live database.
+type databaseSource struct {
+	database figFirestore
+}
+
+// NewDatabaseSource connects to a database to sync from. An empty database selects the
+// (default) database. Defer the returned close function.
+func NewDatabaseSource(keyPath string, database string) (SyncSource, func(), error) {
+	ff, close, err := newFirestore(keyPath, database)
+	if err != nil {
+		return nil, close, err
+	}
+	return databaseSource{ff}, close, nil
+}
+
+func (s databaseSource) ReadCollection(colPath string, recursive bool) ([]ExportDoc, error) {
+	return collectDocs(s.database, colPath, recursive)
+}
+
+// collectDocs reads every document in a collection, sorted by path. Document data is
+// encoded with its types. With recursive, the subcollections of each document are read too.
+func collectDocs(f figFirestore, colPath string, recursive bool) ([]ExportDoc, error) {
+	docs := []ExportDoc{}
+	paths, err := f.listDocPaths(colPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		data, err := f.getDocData(p)
+		if err != nil {
+			return nil, err
+		}
+		// a missing document may still hold subcollections
+		if len(data) > 0 {
+			docs = append(docs, ExportDoc{DocPath: p, Data: encodeTyped(data, f).(map[string]any)})
+		}
+		if !recursive {
+			continue
+		}
+		cols, err := f.listCollections(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range cols {
+			sub, err := collectDocs(f, col, true)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, sub...)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].DocPath < docs[j].DocPath })
+	return docs, nil
+}
+
+// inCollection reports whether docPath is a document of the collection, or of one of its
+// subcollections if recursive.
+func inCollection(docPath string, colPath string, recursive bool) bool {
+	rest := strings.TrimPrefix(docPath, colPath+"/")
+	if rest == docPath || rest == "" {
+		return false
+	}
+	segments := len(strings.Split(rest, "/"))
+	return segments == 1 || (recursive && segments%2 == 1)
+}
+
+// Sync stages the changes which make a collection of the connected database match the
+// source. Missing documents are Set, differing documents are Updated with the changed top
+// level fields, or Set when fields were removed, and documents absent from the source are
+// Deleted. Relative references in the source are resolved against the connected database.
+func (m *Migrator) Sync(source SyncSource, colPath string, recursive bool) error {
+	want, err := source.ReadCollection(colPath, recursive)
+	if err != nil {
+		return err
+	}
+	have, err := collectDocs(m.database, colPath, recursive)
+	if err != nil {
+		return err
+	}
+	current := map[string]map[string]any{}
+	for _, d := range have {
+		if current[d.DocPath], err = decodeDoc(d.Data, m.database); err != nil {
+			return err
+		}
+	}
+
+	stager := m.Stage()
+	for _, d := range want {
+		if !inCollection(d.DocPath, colPath, recursive) {
+			continue
+		}
+		data, err := decodeDoc(d.Data, m.database)
+		if err != nil {
+			return err
+		}
+		before, ok := current[d.DocPath]
+		delete(current, d.DocPath)
+		if !ok {
+			err = stager.Set(d.DocPath, data)
+		} else if patch, set := syncPatch(before, data, m.database); set {
+			err = stager.Set(d.DocPath, data)
+		} else if len(patch) > 0 {
+			err = stager.Update(d.DocPath, patch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	removed := []string{}
+	for docPath := range current {
+		removed = append(removed, docPath)
+	}
+	sort.Strings(removed)
+	for _, docPath := range removed {
+		if err := stager.Delete(docPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPatch returns the top level fields of after which differ from before. It reports set
+// if any field of before is missing from after, which an update cannot express.
+func syncPatch(before map[string]any, after map[string]any, f figFirestore) (map[string]any, bool) {
+	patch := map[string]any{}
+	for _, fc := range diffData(before, after, f) {
+		if fc.Kind == DiffRemoved {
+			return nil, true
+		}
+		patch[fc.Path[0]] = after[fc.Path[0]]
+	}
+	return patch, false
+}
@@ -0,0 +1,390 @@
+package fig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-isatty"
+)
+
+// Terminal control sequences used by the browser.
+const (
+	termAltScreen  = "\x1b[?1049h"
+	termMainScreen = "\x1b[?1049l"
+	termClear      = "\x1b[H\x1b[2J"
+)
+
+// browser is the full screen terminal UI for browsing, reviewing and running stored migrations.
+// Commands are typed and confirmed with enter so no raw terminal mode is required.
+type browser struct {
+	m      *Migrator
+	in     io.Reader
+	out    io.Writer
+	tty    bool
+	width  int
+	height int
+}
+
+// migrationEntry is one stored migration in the browser list.
+type migrationEntry struct {
+	name     string
+	executed bool
+	changes  int
+	err      error
+}
+
+// newBrowser returns a browser reading commands from in and drawing to out.
+func newBrowser(m *Migrator, in io.Reader, out io.Writer, tty bool) *browser {
+	// migrations are loaded into a copy, so the caller's staged migration is left untouched
+	view := *m
+	view.changes = []*Change{}
+	view.hasRun = false
+	view.verification = nil
+	view.target = migrationTarget{}
+	view.findings = nil
+	view.presented = ""
+	view.replaced = nil
+	b := browser{
+		m:      &view,
+		in:     in,
+		out:    out,
+		tty:    tty,
+		width:  envSize("COLUMNS", 120),
+		height: envSize("LINES", 40),
+	}
+	return &b
+}
+
+// envSize returns a positive integer from the environment or the default.
+func envSize(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// isTerminal reports whether the writer is an interactive terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && (isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd()))
+}
+
+// Browse lists the stored migrations with their executed status. On a terminal it then opens
+// the full screen browser. Otherwise it prints the list as plain output and returns.
+func (m *Migrator) Browse(in io.Reader, out io.Writer) error {
+	b := newBrowser(m, in, out, isTerminal(out))
+	return b.run()
+}
+
+// run draws the migration list and dispatches commands until the user quits.
+func (b *browser) run() error {
+	entries, err := b.entries()
+	if err != nil {
+		return err
+	}
+	if !b.tty {
+		fmt.Fprint(b.out, b.renderList(entries))
+		return nil
+	}
+
+	fmt.Fprint(b.out, termAltScreen)
+	defer fmt.Fprint(b.out, termMainScreen)
+
+	message := ""
+	for {
+		b.draw(b.renderList(entries), message, "<number>: open  r: refresh  q: quit")
+		message = ""
+		line, err := readLine(b.in)
+		if err != nil && line == "" {
+			return nil
+		}
+		switch line {
+		case "q":
+			return nil
+		case "r", "":
+			if entries, err = b.entries(); err != nil {
+				return err
+			}
+		default:
+			i, err := strconv.Atoi(line)
+			if err != nil || i < 1 || i > len(entries) {
+				message = "< unknown command " + line + " >"
+				continue
+			}
+			message = b.openMigration(entries[i-1].name)
+			if entries, err = b.entries(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// draw clears the screen and renders a body with a status line and command help.
+func (b *browser) draw(body string, message string, help string) {
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+	room := b.height - 4
+	if room > 0 && len(lines) > room {
+		lines = append(lines[:room], fmt.Sprintf("... %d more lines", len(lines)-room))
+	}
+	fmt.Fprint(b.out, termClear)
+	fmt.Fprintln(b.out, strings.Join(lines, "\n"))
+	if message != "" {
+		fmt.Fprintln(b.out, message)
+	}
+	fmt.Fprintln(b.out, clrTheme().blue(help))
+	fmt.Fprint(b.out, "> ")
+}
+
+// entries loads the stored migrations with their executed status.
+func (b *browser) entries() ([]migrationEntry, error) {
+	store, err := b.m.migrationStore()
+	if err != nil {
+		return nil, err
+	}
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	entries := []migrationEntry{}
+	for _, name := range names {
+		var mig Migration
+		err := store.Load(name, &mig)
+		entries = append(entries, migrationEntry{
+			name:     name,
+			executed: mig.Executed,
+			changes:  len(mig.ChangeUnits),
+			err:      err,
+		})
+	}
+	return entries, nil
+}
+
+// renderList returns the numbered list of stored migrations.
+func (b *browser) renderList(entries []migrationEntry) string {
+	out := fmt.Sprintf("Migrations in %s\n\n", b.m.storagePath)
+	if len(entries) == 0 {
+		return out + "< no migrations >\n"
+	}
+	width := 0
+	for _, e := range entries {
+		width = maxNum(width, len(e.name))
+	}
+	for i, e := range entries {
+		status := "pending "
+		if e.executed {
+			status = "executed"
+		}
+		if e.err != nil {
+			status = "unreadable"
+		}
+		out += fmt.Sprintf("%4d  %-*s  %s  %d changes\n", i+1, width, e.name, status, e.changes)
+	}
+	return out
+}
+
+// openMigration loads a migration and shows its change tree until the user goes back.
+// It returns a status message for the list screen.
+func (b *browser) openMigration(name string) string {
+	b.m.setName(name)
+	if err := b.m.LoadMigration(); err != nil {
+		return "LoadError: " + err.Error()
+	}
+	if err := b.m.PrepMigration(); err != nil {
+		return "PrepError: " + err.Error()
+	}
+
+	message := ""
+	for {
+		b.draw(b.renderTree(), message, "<number>: view change  run: run migration  rollback: run rollback  b: back")
+		message = ""
+		line, err := readLine(b.in)
+		if err != nil && line == "" {
+			return ""
+		}
+		switch line {
+		case "b", "q":
+			return ""
+		case "run":
+			message = b.runMigration()
+		case "rollback":
+			message = b.runRollback(name)
+		default:
+			i, err := strconv.Atoi(line)
+			if err != nil || i < 1 || i > len(b.m.changes) {
+				message = "< unknown command " + line + " >"
+				continue
+			}
+			b.viewChange(i - 1)
+		}
+	}
+}
+
+// renderTree returns the staged changes grouped into a tree by collection path.
+func (b *browser) renderTree() string {
+	out := b.m.renderHeader() + "\n"
+	groups := map[string][]int{}
+	cols := []string{}
+	for i, c := range b.m.changes {
+		col := c.collectionPath()
+		if _, ok := groups[col]; !ok {
+			cols = append(cols, col)
+		}
+		groups[col] = append(groups[col], i)
+	}
+	sort.Strings(cols)
+	for _, col := range cols {
+		depth := strings.Count(col, "/") / 2
+		out += fmt.Sprintf("%s%s/\n", strings.Repeat("  ", depth), clrTheme().blue(col))
+		for _, i := range groups[col] {
+			c := b.m.changes[i]
+			id := c.docPath[strings.LastIndex(c.docPath, "/")+1:]
+			status := fmt.Sprintf("%d fields", len(c.diff))
+			if c.errState != nil {
+				status = clrTheme().red("error")
+			}
+			out += fmt.Sprintf("%s  %4d  %-8s %s  %s\n", strings.Repeat("  ", depth), i+1, strings.ToUpper(c.commandString()), id, status)
+		}
+	}
+	return out
+}
+
+// viewChange shows one change with its before and after documents side by side.
+func (b *browser) viewChange(i int) {
+	for {
+		c := b.m.changes[i]
+		body := b.m.renderChange(c, false) + "\n" + b.sideBySide(c)
+		b.draw(body, "", fmt.Sprintf("[ change %d/%d ]  n: next  p: previous  b: back", i+1, len(b.m.changes)))
+		line, err := readLine(b.in)
+		if err != nil && line == "" {
+			return
+		}
+		switch line {
+		case "n", "":
+			if i < len(b.m.changes)-1 {
+				i++
+			}
+		case "p":
+			if i > 0 {
+				i--
+			}
+		case "b", "q":
+			return
+		}
+	}
+}
+
+// sideBySide returns the before and after documents as two columns of indented json.
+func (b *browser) sideBySide(c *Change) string {
+	if c.errState != nil {
+		return ""
+	}
+	sBefore, sAfter := c.beforeAfterCache()
+	left := jsonLines(sBefore)
+	right := jsonLines(sAfter)
+	col := (b.width - 3) / 2
+	out := fmt.Sprintf("%s | %s\n", padColumn("BEFORE", col), "AFTER")
+	out += strings.Repeat("-", col) + "-+-" + strings.Repeat("-", col) + "\n"
+	for k := 0; k < maxNum(len(left), len(right)); k++ {
+		l, r := "", ""
+		if k < len(left) {
+			l = left[k]
+		}
+		if k < len(right) {
+			r = right[k]
+		}
+		out += fmt.Sprintf("%s | %s\n", padColumn(l, col), truncateColumn(r, col))
+	}
+	return out
+}
+
+// jsonLines returns the lines of indented json for the data.
+func jsonLines(data any) []string {
+	js, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return strings.Split(string(js), "\n")
+}
+
+// truncateColumn cuts a line to the column width.
+func truncateColumn(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:maxNum(width-3, 0)]) + "..."
+}
+
+// padColumn truncates or pads a line to exactly the column width.
+func padColumn(s string, width int) string {
+	s = truncateColumn(s, width)
+	return s + strings.Repeat(" ", maxNum(width-utf8.RuneCountInString(s), 0))
+}
+
+// runMigration confirms and runs the open migration, drawing each change result as it lands.
+// A migration which has already run needs rerun typed to apply its changes again.
+func (b *browser) runMigration() string {
+	fmt.Fprint(b.out, termClear+b.m.renderHeader()+b.m.renderSummary())
+	prompt, confirm := "Type yes to execute these changes:", "yes"
+	if b.m.hasRun {
+		prompt, confirm = "This migration has already run. Type rerun to apply its changes again:", "rerun"
+	}
+	fmt.Fprintln(b.out, "\n"+prompt)
+	line, _ := readLine(b.in)
+	if line != confirm {
+		return "No changes applied."
+	}
+	rerun := b.m.rerun
+	b.m.SetRerun(true)
+	defer b.m.SetRerun(rerun)
+
+	fmt.Fprint(b.out, termClear)
+	total := len(b.m.changes)
+	done := 0
+	registered := b.m.hooks.afterChange
+	b.m.AfterChange(func(c *Change, result ChangeResult) {
+		done++
+		status := clrTheme().green(string(result.Status))
+		if result.Status == ChangeSkipped {
+			status = clrTheme().yellow(string(result.Status)) + " " + result.Error
+		} else if result.Status == ChangeFailed {
+			status = clrTheme().red(string(result.Status)) + " " + result.Error
+		}
+		fmt.Fprintf(b.out, "[%d/%d] %s %s\n", done, total, result.DocPath, status)
+	})
+	defer func() { b.m.hooks.afterChange = registered }()
+
+	report, err := b.m.RunMigration()
+	if err != nil {
+		return "RunError: " + err.Error()
+	}
+	if report.Verification != nil {
+		fmt.Fprint(b.out, "\n"+report.Verification.Present())
+	}
+	fmt.Fprintln(b.out, "\nPress enter to continue.")
+	readLine(b.in)
+	return fmt.Sprintf("Complete. %d applied, %d skipped, %d failed.", report.appliedCount(), len(report.Skipped()), len(report.Failed()))
+}
+
+// runRollback loads the rollback generated for a migration and runs it.
+func (b *browser) runRollback(name string) string {
+	b.m.setName(name + "_rollback")
+	defer func() {
+		b.m.setName(name)
+		b.m.LoadMigration()
+		b.m.PrepMigration()
+	}()
+	if err := b.m.LoadMigration(); err != nil {
+		return "LoadError: " + err.Error()
+	}
+	if err := b.m.PrepMigration(); err != nil {
+		return "PrepError: " + err.Error()
+	}
+	return b.runMigration()
+}
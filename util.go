@@ -1,8 +1,11 @@
 package fig
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -16,7 +19,6 @@ import (
 	"cloud.google.com/go/firestore"
 	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/fatih/color"
-	"github.com/nsf/jsondiff"
 )
 
 type colorTheme struct {
@@ -49,34 +51,78 @@ func clrTheme() *colorTheme {
 	return &clrthm
 }
 
-// PrettyDiff returns the pretty formatted difference between a before and after map.
-func prettyDiff(b map[string]any, a map[string]any) (string, error) {
-	bm, err := json.Marshal(b)
-	if err != nil {
-		return "", err
-	}
+// maxPresentItems, maxPresentString and maxPresentFields bound the size of arrays, strings
+// and field lists in abbreviated diffs.
+const (
+	maxPresentItems  = 10
+	maxPresentString = 80
+	maxPresentFields = 25
+)
 
-	am, err := json.Marshal(a)
-	if err != nil {
-		return "", err
-	}
+// abbreviate returns a copy of serialized data with long arrays and strings truncated. Each
+// truncation is marked with the amount removed and a short hash of the full value, so values
+// which differ only in the truncated part still show up as different in a diff.
+func abbreviate(data any) any {
+	switch v := data.(type) {
+	case map[string]any:
+		newData := map[string]any{}
+		for k, d := range v {
+			newData[k] = abbreviate(d)
+		}
+		return newData
 
-	opt := jsondiff.Options{
-		Added: jsondiff.Tag{
-			Begin: clrTheme().green("+ "),
-		},
-		Removed: jsondiff.Tag{
-			Begin: clrTheme().red("- "),
-		},
-		ChangedSeparator: clrTheme().yellow(" -> "),
-		Indent:           "    ",
-		SkipMatches:      true,
-	}
+	case []any:
+		if len(v) <= maxPresentItems {
+			newData := []any{}
+			for _, d := range v {
+				newData = append(newData, abbreviate(d))
+			}
+			return newData
+		}
+		newData := []any{}
+		for _, d := range v[:maxPresentItems] {
+			newData = append(newData, abbreviate(d))
+		}
+		js, _ := json.Marshal(v[maxPresentItems:])
+		return append(newData, fmt.Sprintf("... %d more items #%s", len(v)-maxPresentItems, shortHash(js)))
 
-	_, s := jsondiff.Compare(bm, am, &opt)
+	case string:
+		if utf8.RuneCountInString(v) <= maxPresentString {
+			return v
+		}
+		runes := []rune(v)
+		return fmt.Sprintf("%s... +%d chars #%s", string(runes[:maxPresentString]), len(runes)-maxPresentString, shortHash([]byte(v)))
+	}
+	return data
+}
 
-	return s, nil
+// shortHash returns the first few hex digits of the sha256 of content.
+func shortHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:6]
+}
 
+// readLine reads a single line of user input. It reads one byte at a time so that no input
+// beyond the line is consumed from a shared reader such as stdin.
+func readLine(in io.Reader) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if len(line) > 0 && err == io.EOF {
+				break
+			}
+			return strings.TrimSpace(string(line)), err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
 }
 
 // GetDiffPatch produces the json patch instructions needed to transform the original to the target.
@@ -89,11 +135,18 @@ func applyDiffPatch(original []byte, patch []byte) ([]byte, error) {
 	return jsonpatch.MergePatch(original, patch)
 }
 
+// timeLayout is the serialized form of a timestamp, at the microsecond precision Firestore
+// stores. Timestamps written with fewer digits still parse.
+const timeLayout = "2006-01-02T15:04:05.000000Z"
+
 // SerializeData converts timestamps, docrefs, and other complex objects into marked strings.
 func serializeData(data any, f figFirestore) any {
 	if reflect.DeepEqual(data, f.deleteField()) {
 		return "<delete>!delete<delete>"
 	}
+	if isServerTimestamp(data) {
+		return serverTimestampMarker
+	}
 
 	v := reflect.ValueOf(data)
 
@@ -115,14 +168,12 @@ func serializeData(data any, f figFirestore) any {
 	default:
 		_, ok := data.(time.Time)
 		if ok {
-			return "<time>" + data.(time.Time).Format("2006-01-02T15:04:05.000Z") + "<time>"
+			return "<time>" + data.(time.Time).UTC().Format(timeLayout) + "<time>"
 		}
 
 		_, ok = data.(*firestore.DocumentRef)
 		if ok && data.(*firestore.DocumentRef) != nil {
-			path := data.(*firestore.DocumentRef).Path
-			path = strings.Split(path, "/(default)/documents/")[1]
-			return "<ref>" + path + "<ref>"
+			return "<ref>" + refPath(data.(*firestore.DocumentRef).Path, f) + "<ref>"
 		}
 
 	}
@@ -149,8 +200,11 @@ func deSerializeData(data any, f figFirestore) any {
 		return newData
 
 	case reflect.String:
-		if strings.HasPrefix(data.(string), "<time>") {
-			time, _ := time.Parse("2006-01-02T15:04:05.000Z", strings.Replace(data.(string), "<time>", "", -1))
+		if data.(string) == serverTimestampMarker {
+			return firestore.ServerTimestamp
+
+		} else if strings.HasPrefix(data.(string), "<time>") {
+			time, _ := time.Parse(time.RFC3339Nano, strings.Replace(data.(string), "<time>", "", -1))
 			return time
 
 		} else if strings.HasPrefix(data.(string), "<ref>") {
@@ -178,7 +232,7 @@ func storeJson(data any, storagePath string, fileName string) error {
 }
 
 // LoadJson reads json from disc and hydrates the data into the provided target.
-func loadJson[T any](fullPath string, target *T) error {
+func loadJson(fullPath string, target any) error {
 	content, err := ioutil.ReadFile(fullPath + ".json")
 	if err != nil {
 		return err
@@ -190,15 +244,6 @@ func loadJson[T any](fullPath string, target *T) error {
 	return nil
 }
 
-// LoadFig wraps loadJson. It first attempts to load the content from the database but fails back to local storage.
-func loadFig[T any](db figFirestore, path string, target *T) error {
-	if strings.HasPrefix(path, "[firestore]/") {
-		suffix := strings.Replace(path, "[firestore]/", "", 1)
-		return db.getDocStruct(target, suffix)
-	}
-	return loadJson(path, target)
-}
-
 // Transform returns new data where instances of before are replaced with after. If after is nil, key is dropped.
 // This function is recursive for slices and maps but not for nested structs.
 func transform(data any, before any, after any) any {
@@ -246,8 +291,11 @@ var clearMap map[string]func() = map[string]func(){
 	},
 }
 
-// clearTerm clears the terminal.
+// clearTerm clears the terminal. Output which is not a terminal is left alone.
 func clearTerm() {
+	if !isTerminal(os.Stdout) {
+		return
+	}
 	if runtime.GOOS == "windows" {
 		clearMap["windows"]()
 		return
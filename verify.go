@@ -0,0 +1,87 @@
+package fig
+
+import (
+	"fmt"
+	"time"
+)
+
+// Verification records whether the documents touched by a run match their presented after
+// values. Field values are serialized the same way as WorkUnit patches.
+type Verification struct {
+	Verified   time.Time     `json:"verified" firestore:"verified"`
+	Checked    int           `json:"checked" firestore:"checked"`
+	Mismatches []DocMismatch `json:"mismatches" firestore:"mismatches"`
+}
+
+// DocMismatch is one document which did not match its presented after value. Fields hold the
+// differences from the document as read back to the expected after value.
+type DocMismatch struct {
+	DocPath string        `json:"docPath" firestore:"docPath"`
+	Fields  []FieldChange `json:"fields,omitempty" firestore:"fields,omitempty"`
+	Error   string        `json:"error,omitempty" firestore:"error,omitempty"`
+}
+
+// Passed reports whether every checked document matched.
+func (v *Verification) Passed() bool {
+	return len(v.Mismatches) == 0
+}
+
+// SetVerify makes RunMigration read back every applied change and compare it with the
+// presented after value.
+func (m *Migrator) SetVerify(verify bool) {
+	m.verify = verify
+}
+
+// verifyChanges reads back the documents of the applied changes and records any that differ
+// from their after values.
+func (m *Migrator) verifyChanges(report *RunReport) *Verification {
+	v := Verification{Verified: time.Now(), Mismatches: []DocMismatch{}}
+	applied := map[string]bool{}
+	for _, res := range report.Results {
+		prev, seen := applied[res.DocPath]
+		applied[res.DocPath] = (prev || !seen) && res.Status == ChangeApplied
+	}
+	for _, c := range m.changes {
+		// a document is checked once against the after value of its last change
+		if !applied[c.docPath] || !c.finalChange() {
+			continue
+		}
+		v.Checked++
+		actual, err := m.database.getDocData(c.docPath)
+		if err != nil {
+			v.Mismatches = append(v.Mismatches, DocMismatch{DocPath: c.docPath, Error: err.Error()})
+			continue
+		}
+		mismatch := DocMismatch{DocPath: c.docPath}
+		for _, fc := range diffData(actual, c.after, m.database) {
+			if fc.Kind == DiffTypeChanged && valueType(fc.Old) == "timestamp" && isServerTimestamp(fc.New) {
+				continue
+			}
+			fc.Old = serializeData(fc.Old, m.database)
+			fc.New = serializeData(fc.New, m.database)
+			mismatch.Fields = append(mismatch.Fields, fc)
+		}
+		if len(mismatch.Fields) > 0 {
+			v.Mismatches = append(v.Mismatches, mismatch)
+		}
+	}
+	return &v
+}
+
+// Present returns the verification outcome with the differing fields of each mismatch.
+func (v *Verification) Present() string {
+	if v.Passed() {
+		return clrTheme().green(fmt.Sprintf("Verified: %d documents match.", v.Checked)) + "\n"
+	}
+	out := clrTheme().red(fmt.Sprintf("Verification failed: %d of %d documents differ.", len(v.Mismatches), v.Checked)) + "\n"
+	for _, mm := range v.Mismatches {
+		out += "  " + mm.DocPath + "\n"
+		if mm.Error != "" {
+			out += "    " + mm.Error + "\n"
+		}
+		for _, fc := range mm.Fields {
+			out += fmt.Sprintf("    %s %s: %s\n", fieldSymbol(fc.Kind), fc.PathString(), fieldValues(fc))
+		}
+	}
+	return out
+}